@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/ningzio/geminal/internal"
 	"github.com/ningzio/geminal/internal/llm"
@@ -11,7 +15,18 @@ import (
 	"github.com/ningzio/geminal/tui"
 )
 
+var (
+	importPersona = flag.String("import-persona", "", "import the persona of a JSON `file` and exit")
+	exportPersona = flag.String("export-persona", "", "print the persona called `name` as JSON and exit")
+	deletePersona = flag.String("delete-persona", "", "delete the persona called `name` and exit")
+	record        = flag.String("record", "", "record the calls of every provider into a cassette in `dir`")
+	export        = flag.String("export", "", "print the conversation with the chat id or title `name` and exit")
+	colour        = flag.String("color", "auto", "render messages in `mode`: auto, truecolor, 256, 16 or none")
+)
+
 func main() {
+	flag.Parse()
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		log.Fatal(err)
@@ -30,8 +45,12 @@ func main() {
 	defer f.Close()
 	log.SetOutput(f)
 
-	apiKey := os.Getenv("API_KEY")
-	ai, err := llm.NewGeminiAI(apiKey)
+	config, err := internal.LoadConfig(filepath.Join(geminalDir, "config.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	registry, err := newRegistry(config)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -40,11 +59,27 @@ func main() {
 	if err != nil {
 		log.Fatalf("init repo: %s", err)
 	}
+	mode, err := colourMode()
+	if err != nil {
+		log.Fatal(err)
+	}
 	h := internal.NewHandler(
-		ai,
+		registry,
 		r,
-		internal.NewChromaRenderer(),
+		internal.NewMarkdownRenderer(mode),
+		config,
 	)
+	if err := h.LoadThemes(filepath.Join(geminalDir, "themes")); err != nil {
+		log.Fatal(err)
+	}
+
+	if ok, err := runCommand(context.Background(), h); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	app, err := tui.NewApplication(h)
 	if err != nil {
@@ -55,3 +90,110 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// runCommand runs the persona or export command given by the flags, it reports
+// false if no such command is given.
+func runCommand(ctx context.Context, h *internal.Handler) (bool, error) {
+	switch {
+	case len(*importPersona) != 0:
+		f, err := os.Open(*importPersona)
+		if err != nil {
+			return true, err
+		}
+		defer f.Close()
+		persona, err := h.ImportPersona(ctx, f)
+		if err != nil {
+			return true, err
+		}
+		fmt.Printf("persona %q imported\n", persona.Name)
+		return true, nil
+	case len(*exportPersona) != 0:
+		return true, h.ExportPersona(ctx, *exportPersona, os.Stdout)
+	case len(*deletePersona) != 0:
+		return true, h.DeletePersona(ctx, *deletePersona)
+	case len(*export) != 0:
+		return true, h.ExportConversation(ctx, *export, os.Stdout)
+	}
+	return false, nil
+}
+
+// colourMode returns the colour mode given by the color flag. An exported
+// conversation is plain text unless it is printed to a terminal.
+func colourMode() (internal.ColourMode, error) {
+	mode, err := internal.ParseColourMode(*colour)
+	if err != nil || mode != internal.ColourAuto {
+		return mode, err
+	}
+	if len(*export) != 0 {
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+			return internal.ColourNone, nil
+		}
+	}
+	return internal.DetectColourMode(), nil
+}
+
+// newRegistry registers the providers configured by the environment. Gemini is
+// registered if API_KEY is set, an OpenAI compatible endpoint if OPENAI_BASE_URL
+// is set and a Ollama server if OLLAMA_HOST or OLLAMA_MODEL is set. Gemini is
+// used if nothing is configured. Every provider retries transient failures as
+// configured by config, and is recorded if the record flag is set.
+func newRegistry(config *internal.Config) (*internal.Registry, error) {
+	registry := internal.NewRegistry()
+	register := func(provider internal.LLM, models ...string) error {
+		if len(*record) != 0 {
+			path := filepath.Join(*record, strings.ReplaceAll(provider.Name(), " ", "_")+".json")
+			recorder, err := llm.NewRecorder(provider, path)
+			if err != nil {
+				return err
+			}
+			provider = recorder
+		}
+		registry.Register(internal.NewRetryLLM(provider, config.Retry), models...)
+		return nil
+	}
+
+	apiKey := os.Getenv("API_KEY")
+	if len(apiKey) != 0 {
+		ai, err := llm.NewGeminiAI(apiKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := register(ai, llm.GeminiDefaultModel); err != nil {
+			return nil, err
+		}
+	}
+
+	if baseURL := os.Getenv("OPENAI_BASE_URL"); len(baseURL) != 0 {
+		model := os.Getenv("OPENAI_MODEL")
+		if len(model) == 0 {
+			model = "gpt-3.5-turbo"
+		}
+		if err := register(llm.NewOpenAI(baseURL, os.Getenv("OPENAI_API_KEY"), model), model); err != nil {
+			return nil, err
+		}
+	}
+
+	host, model := os.Getenv("OLLAMA_HOST"), os.Getenv("OLLAMA_MODEL")
+	if len(host) != 0 || len(model) != 0 {
+		if len(host) == 0 {
+			host = "http://localhost:11434"
+		}
+		if len(model) == 0 {
+			model = "llama2"
+		}
+		if err := register(llm.NewOllama(host, model), model); err != nil {
+			return nil, err
+		}
+	}
+
+	if provider, _ := registry.Default(); len(provider) == 0 {
+		ai, err := llm.NewGeminiAI(apiKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := register(ai, llm.GeminiDefaultModel); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
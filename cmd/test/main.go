@@ -1,6 +1,8 @@
 package main
 
 import (
+	_ "embed"
+	"flag"
 	"log"
 	"os"
 
@@ -10,7 +12,17 @@ import (
 	"github.com/ningzio/geminal/tui"
 )
 
+var cassette = flag.String("cassette", "", "replay the cassette at `path` instead of the demo cassette")
+
+// demo is the cassette replayed by default, it is embedded so the demo runs
+// from any directory.
+//
+//go:embed demo.json
+var demo []byte
+
 func main() {
+	flag.Parse()
+
 	f, err := os.OpenFile("geminal.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatal(err)
@@ -18,14 +30,25 @@ func main() {
 	defer f.Close()
 	log.SetOutput(f)
 
+	c, err := llm.ParseCassette(demo)
+	if len(*cassette) != 0 {
+		c, err = llm.LoadCassette(*cassette)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	r, err := repo.NewRepository()
 	if err != nil {
 		log.Fatalf("init repo: %s", err)
 	}
+	registry := internal.NewRegistry()
+	registry.Register(internal.NewRetryLLM(llm.NewReplay(c), internal.RetryConfig{}), "replay")
 	h := internal.NewHandler(
-		&llm.Mock{},
+		registry,
 		r,
-		internal.NewChromaRenderer(),
+		internal.NewMarkdownRenderer(internal.ColourAuto),
+		&internal.Config{},
 	)
 
 	app, err := tui.NewApplication(h)
@@ -8,7 +8,10 @@ require (
 	github.com/gdamore/tcell/v2 v2.6.1-0.20231203215052-2917c3801e73
 	github.com/google/generative-ai-go v0.5.0
 	github.com/google/uuid v1.4.0
+	github.com/googleapis/gax-go/v2 v2.12.0
+	github.com/mattn/go-runewidth v0.0.15
 	github.com/rivo/tview v0.0.0-20240101144852-b3bd1aa5e9f2
+	github.com/yuin/goldmark v1.6.0
 	google.golang.org/api v0.149.0
 )
 
@@ -30,10 +33,8 @@ require (
 	github.com/google/flatbuffers v1.12.1 // indirect
 	github.com/google/s2a-go v0.1.7 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.3.2 // indirect
-	github.com/googleapis/gax-go/v2 v2.12.0 // indirect
 	github.com/klauspost/compress v1.12.3 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
-	github.com/mattn/go-runewidth v0.0.15 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/rivo/uniseg v0.4.3 // indirect
 	go.opencensus.io v0.24.0 // indirect
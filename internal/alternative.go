@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Alternative is one of several answers to the same prompt.
+type Alternative struct {
+	Role        string
+	ContentType string
+	Content     string
+	ErrMsg      string        `json:",omitempty"`
+	Meta        *ResponseMeta `json:",omitempty"`
+	Tokens      int           `json:",omitempty"`
+
+	CreatedAt      time.Time
+	Provider       string        `json:",omitempty"`
+	Model          string        `json:",omitempty"`
+	Latency        time.Duration `json:",omitempty"`
+	PromptTokens   int           `json:",omitempty"`
+	ResponseTokens int           `json:",omitempty"`
+}
+
+// alternativeOf returns the answer msg as an alternative.
+func alternativeOf(msg *Message) *Alternative {
+	return &Alternative{
+		Role:        msg.Role,
+		ContentType: msg.ContentType,
+		Content:     msg.Content,
+		ErrMsg:      msg.ErrMsg,
+		Meta:        msg.Meta,
+		Tokens:      msg.Tokens,
+
+		CreatedAt:      msg.CreatedAt,
+		Provider:       msg.Provider,
+		Model:          msg.Model,
+		Latency:        msg.Latency,
+		PromptTokens:   msg.PromptTokens,
+		ResponseTokens: msg.ResponseTokens,
+	}
+}
+
+// collectAlternatives puts the answer msg in front of the extra candidates a
+// LLM returned with it, so msg holds all of them and shows the first.
+func collectAlternatives(msg *Message) {
+	if len(msg.Alternatives) == 0 {
+		return
+	}
+	msg.Alternatives = append([]*Alternative{alternativeOf(msg)}, msg.Alternatives...)
+	msg.Selected = 0
+}
+
+// addAlternatives adds the answer result and its alternatives to the
+// alternatives of the answer msg and selects result.
+func (msg *Message) addAlternatives(result *Message) {
+	if len(msg.Alternatives) == 0 {
+		msg.Alternatives = []*Alternative{alternativeOf(msg)}
+	}
+	selected := len(msg.Alternatives)
+	if len(result.Alternatives) == 0 {
+		msg.Alternatives = append(msg.Alternatives, alternativeOf(result))
+	} else {
+		msg.Alternatives = append(msg.Alternatives, result.Alternatives...)
+	}
+	msg.selectAlternative(selected)
+}
+
+// selectAlternative shows the alternative i of msg, msg is sent as context
+// with the content of the selected alternative.
+func (msg *Message) selectAlternative(i int) {
+	alternative := msg.Alternatives[i]
+	msg.Selected = i
+	msg.Role = alternative.Role
+	msg.ContentType = alternative.ContentType
+	msg.Content = alternative.Content
+	msg.ErrMsg = alternative.ErrMsg
+	msg.Meta = alternative.Meta
+	msg.Tokens = alternative.Tokens
+	msg.CreatedAt = alternative.CreatedAt
+	msg.Provider = alternative.Provider
+	msg.Model = alternative.Model
+	msg.Latency = alternative.Latency
+	msg.PromptTokens = alternative.PromptTokens
+	msg.ResponseTokens = alternative.ResponseTokens
+}
+
+// errNoAnswer is returned when a conversation has no answer to act on.
+var errNoAnswer = errors.New("there is no answer yet")
+
+// lastExchange returns the last prompt of conv and its answer.
+func lastExchange(conv *Conversation) (prompt, answer *Message, err error) {
+	n := len(conv.Messages)
+	if n < 2 || conv.Messages[n-2].Role != RoleUser || conv.Messages[n-1].Role == RoleUser {
+		return nil, nil, errNoAnswer
+	}
+	return conv.Messages[n-2], conv.Messages[n-1], nil
+}
+
+// Regenerate implements tui.Backend.
+//
+// The last prompt is sent again with the same history, the new answer is
+// rendered to writer and becomes the selected alternative of the last answer.
+// A failed answer is retried instead, the new answer replaces it. So is a
+// prompt which was saved without an answer, e.g. because geminal was quit.
+func (h *Handler) Regenerate(ctx context.Context, chatID string, writer io.Writer) error {
+	unlock, err := h.lock(chatID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	var prompt, answer *Message
+	if n := len(conv.Messages); n != 0 && conv.Messages[n-1].Role == RoleUser {
+		prompt = conv.Messages[n-1]
+	} else if prompt, answer, err = lastExchange(conv); err != nil {
+		return err
+	}
+	if err := h.loadAttachments(ctx, conv.Messages); err != nil {
+		return err
+	}
+
+	llm, model, err := h.registry.Resolve(conv.Provider, conv.Model)
+	if err != nil {
+		return err
+	}
+	conv.Messages = conv.Messages[:len(conv.Messages)-1]
+	if answer != nil {
+		conv.Messages = conv.Messages[:len(conv.Messages)-1]
+	}
+	history := h.fitHistory(ctx, conv, llm, model, prompt)
+
+	result, talkErr := h.talk(ctx, conv, llm, conv.options(model), history, writer, prompt)
+	switch {
+	case answer == nil || answer.Failed():
+		// a failed retry replaces the old failure
+		answer = result
+	case talkErr != nil:
+		// the answers so far are kept as they were, the failure is rendered
+		return reported(talkErr)
+	default:
+		answer.addAlternatives(result)
+	}
+
+	conv.Messages = append(conv.Messages, prompt, answer)
+	if err := h.saveConversation(ctx, conv); err != nil {
+		return err
+	}
+	return reported(talkErr)
+}
+
+// SelectAlternative implements tui.Backend.
+func (h *Handler) SelectAlternative(ctx context.Context, chatID string, delta int) error {
+	unlock, err := h.lock(chatID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	_, answer, err := lastExchange(conv)
+	if err != nil {
+		return err
+	}
+	n := len(answer.Alternatives)
+	if n < 2 {
+		return errors.New("the last answer has no alternatives, regenerate it first")
+	}
+	answer.selectAlternative(((answer.Selected+delta)%n + n) % n)
+
+	// the sessions know the answer which was selected before
+	h.dropSessions(chatID)
+	return h.saveConversation(ctx, conv)
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// limits of the files which can be attached to a message
+const (
+	maxImageSize = 20 << 20
+	maxTextSize  = 1 << 20
+)
+
+// imageTypes are the MIME types of images by file extension.
+var imageTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".webp": "image/webp",
+}
+
+// Attachment is a file sent together with a message. The content is stored
+// by its digest in the repository, Data holds it while the message is in use.
+type Attachment struct {
+	Name     string
+	MIMEType string
+	Size     int64
+	// Digest is the hex encoded sha256 of the content.
+	Digest string
+	Data   []byte `json:"-"`
+}
+
+// IsImage tells whether the attachment is an image, other attachments are text.
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.MIMEType, "image/")
+}
+
+// readAttachment reads the file at path as an attachment. Images must be PNG,
+// JPEG or WebP, any other file must be UTF-8 text.
+func readAttachment(path string) (*Attachment, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, rest)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("attach: %w", err)
+	}
+	mimeType, isImage := imageTypes[strings.ToLower(filepath.Ext(path))]
+	limit := int64(maxTextSize)
+	if isImage {
+		limit = maxImageSize
+	}
+	if info.Size() > limit {
+		return nil, fmt.Errorf("attach %s: file is larger than %d MB", info.Name(), limit>>20)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("attach: %w", err)
+	}
+	if !isImage {
+		if !utf8.Valid(data) || !strings.HasPrefix(http.DetectContentType(data), "text/") {
+			return nil, fmt.Errorf("attach %s: only PNG, JPEG, WebP images and text files are supported", info.Name())
+		}
+		mimeType = "text/plain"
+	}
+
+	sum := sha256.Sum256(data)
+	return &Attachment{
+		Name:     info.Name(),
+		MIMEType: mimeType,
+		Size:     int64(len(data)),
+		Digest:   hex.EncodeToString(sum[:]),
+		Data:     data,
+	}, nil
+}
+
+// attach reads the files at paths, stores them and adds them to message.
+func (h *Handler) attach(ctx context.Context, message *Message, paths []string) error {
+	for _, path := range paths {
+		attachment, err := readAttachment(path)
+		if err != nil {
+			return err
+		}
+		if err := h.repo.SaveAttachment(ctx, attachment.Digest, attachment.Data); err != nil {
+			return err
+		}
+		message.Attachments = append(message.Attachments, attachment)
+	}
+	if len(message.Attachments) != 0 {
+		message.ContentType = ContentTypeMultipart
+	}
+	return nil
+}
+
+// loadAttachments loads the content of the attachments of messages which
+// are not loaded yet.
+func (h *Handler) loadAttachments(ctx context.Context, messages []*Message) error {
+	for _, msg := range messages {
+		for _, attachment := range msg.Attachments {
+			if attachment.Data != nil {
+				continue
+			}
+			data, err := h.repo.LoadAttachment(ctx, attachment.Digest)
+			if err != nil {
+				return fmt.Errorf("load attachment %s: %w", attachment.Name, err)
+			}
+			attachment.Data = data
+		}
+	}
+	return nil
+}
+
+// formatSize formats a size in bytes for humans.
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
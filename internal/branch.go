@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/ningzio/geminal/tui"
+)
+
+// Branch is a continuation of a conversation which is not selected. It starts
+// with a prompt which is a sibling of a prompt on the selected path.
+//
+// A conversation is a tree of messages, Conversation.Messages is its selected
+// path. The first prompt of every continuation on the path holds the branches
+// of its siblings, the path goes on with the branch at BranchIndex among them.
+type Branch struct {
+	Messages []*Message
+}
+
+// siblings returns the continuations of conv from the prompt at i on, the
+// selected one is conv.Messages[i:].
+func siblings(conv *Conversation, i int) [][]*Message {
+	head := conv.Messages[i]
+	all := make([][]*Message, 0, len(head.Branches)+1)
+	for _, branch := range head.Branches {
+		all = append(all, branch.Messages)
+	}
+	return slices.Insert(all, min(head.BranchIndex, len(all)), conv.Messages[i:])
+}
+
+// selectBranch continues conv at i with the continuation selected of all,
+// the others are kept as its branches.
+func selectBranch(conv *Conversation, i int, all [][]*Message, selected int) {
+	var branches []*Branch
+	for k, messages := range all {
+		if k == selected {
+			continue
+		}
+		// only the head on the path holds the branches
+		messages[0].Branches, messages[0].BranchIndex = nil, 0
+		branches = append(branches, &Branch{Messages: messages})
+	}
+
+	tail := all[selected]
+	tail[0].Branches, tail[0].BranchIndex = branches, selected
+	conv.Messages = append(slices.Clone(conv.Messages[:i]), tail...)
+
+	// the summary may cover messages which are not on the path anymore
+	if conv.Summary != nil && conv.Summary.Covers > i {
+		conv.Summary = nil
+	}
+}
+
+// prompt returns the user message of conv at index.
+func prompt(conv *Conversation, index int) (*Message, error) {
+	if index < 0 || index >= len(conv.Messages) || conv.Messages[index].Role != RoleUser {
+		return nil, fmt.Errorf("message %d is not a prompt", index)
+	}
+	return conv.Messages[index], nil
+}
+
+// ListPrompts implements tui.Backend.
+func (h *Handler) ListPrompts(ctx context.Context, chatID string) ([]*tui.Prompt, error) {
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	var prompts []*tui.Prompt
+	for i, msg := range conv.Messages {
+		if msg.Role == RoleUser {
+			prompts = append(prompts, &tui.Prompt{Index: i, Content: msg.Content})
+		}
+	}
+	return prompts, nil
+}
+
+// EditPrompt implements tui.Backend.
+//
+// The edited prompt starts a new branch next to the prompt at index, it keeps
+// the attachments of the prompt. The prompt and its answer are rendered to writer.
+func (h *Handler) EditPrompt(ctx context.Context, chatID string, index int, writer io.Writer, content string) error {
+	unlock, err := h.lock(chatID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	old, err := prompt(conv, index)
+	if err != nil {
+		return err
+	}
+	if err := h.loadAttachments(ctx, conv.Messages); err != nil {
+		return err
+	}
+
+	message := newPrompt(chatID, content)
+	message.ContentType = old.ContentType
+	message.Attachments = old.Attachments
+	h.renderer(writer).RenderMessage(writer, message)
+
+	llm, model, err := h.registry.Resolve(conv.Provider, conv.Model)
+	if err != nil {
+		return err
+	}
+	all := siblings(conv, index)
+	conv.Messages = conv.Messages[:index]
+	if conv.Summary != nil && conv.Summary.Covers > index {
+		conv.Summary = nil
+	}
+	countTokens(ctx, llm, model, message)
+	history := h.fitHistory(ctx, conv, llm, model, message)
+
+	// the new branch is saved before the call, so it survives a failed call or a crash
+	all = append(all, []*Message{message})
+	selectBranch(conv, index, all, len(all)-1)
+	if err := h.saveConversation(ctx, conv); err != nil {
+		return err
+	}
+
+	// the sessions know the old branch
+	h.dropSessions(chatID)
+	result, talkErr := h.talk(ctx, conv, llm, conv.options(model), history, writer, message)
+	if talkErr != nil {
+		// the new branch is kept with its failed answer, Regenerate retries it
+		log.Printf("talk to %s in %s: %v", llm.Name(), chatID, talkErr)
+	}
+	conv.Messages = append(conv.Messages, result)
+	if err := h.saveConversation(ctx, conv); err != nil {
+		return err
+	}
+	return reported(talkErr)
+}
+
+// ListBranches implements tui.Backend.
+func (h *Handler) ListBranches(ctx context.Context, chatID string) ([]*tui.Branch, error) {
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	var branches []*tui.Branch
+	for i, msg := range conv.Messages {
+		if msg.Role != RoleUser || len(msg.Branches) == 0 {
+			continue
+		}
+		all := siblings(conv, i)
+		for k, messages := range all {
+			first, _, _ := strings.Cut(strings.TrimSpace(messages[0].Content), "\n")
+			branches = append(branches, &tui.Branch{
+				Index:    i,
+				Branch:   k,
+				Count:    len(all),
+				Prompt:   first,
+				Selected: k == msg.BranchIndex,
+			})
+		}
+	}
+	return branches, nil
+}
+
+// SwitchBranch implements tui.Backend.
+func (h *Handler) SwitchBranch(ctx context.Context, chatID string, index, branch int) error {
+	unlock, err := h.lock(chatID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	if _, err := prompt(conv, index); err != nil {
+		return err
+	}
+	all := siblings(conv, index)
+	if branch < 0 || branch >= len(all) {
+		return fmt.Errorf("message %d has no branch %d", index, branch)
+	}
+	selectBranch(conv, index, all, branch)
+
+	// the sessions know the old branch
+	h.dropSessions(chatID)
+	return h.saveConversation(ctx, conv)
+}
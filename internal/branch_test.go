@@ -0,0 +1,204 @@
+package internal_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ningzio/geminal/internal"
+)
+
+// echoLLM answers a prompt with "re: " and the prompt.
+type echoLLM struct{}
+
+func (echoLLM) Name() string { return "echo" }
+
+func (echoLLM) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+	return nil
+}
+
+func (ai echoLLM) Talk(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
+	return &internal.Message{ChatID: chatID, Role: ai.Name(), Content: "re: " + messages[len(messages)-1].Content}, nil
+}
+
+// branchStep edits the prompt at index to content, or switches to branch at
+// index if content is empty.
+type branchStep struct {
+	index   int
+	content string
+	branch  int
+}
+
+func TestBranches(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []branchStep
+		// covers is the Covers of the summary of a conversation before the
+		// steps, 0 if it has none
+		covers int
+		// path is the selected path, branches are the branches listed as
+		// index:branch/count prompt, with a * on the selected one
+		path     string
+		branches string
+		// summary is the Covers of the summary after the steps, 0 if it is cleared
+		summary int
+	}{
+		{
+			name:     "first prompt",
+			steps:    []branchStep{{index: 0, content: "q0"}},
+			path:     "q0 | re: q0",
+			branches: "0:0/2 p0, 0:1/2 q0*",
+		},
+		{
+			name:     "middle prompt",
+			steps:    []branchStep{{index: 2, content: "q1"}},
+			path:     "p0 | a0 | q1 | re: q1",
+			branches: "2:0/2 p1, 2:1/2 q1*",
+		},
+		{
+			name:     "prompt with branches",
+			steps:    []branchStep{{index: 2, content: "q1"}, {index: 2, content: "r1"}},
+			path:     "p0 | a0 | r1 | re: r1",
+			branches: "2:0/3 p1, 2:1/3 q1, 2:2/3 r1*",
+		},
+		{
+			name:     "switch back",
+			steps:    []branchStep{{index: 2, content: "q1"}, {index: 2, branch: 0}},
+			path:     "p0 | a0 | p1 | a1 | p2 | a2",
+			branches: "2:0/2 p1*, 2:1/2 q1",
+		},
+		{
+			name:     "switch back and forth",
+			steps:    []branchStep{{index: 2, content: "q1"}, {index: 2, content: "r1"}, {index: 2, branch: 0}, {index: 2, branch: 1}},
+			path:     "p0 | a0 | q1 | re: q1",
+			branches: "2:0/3 p1, 2:1/3 q1*, 2:2/3 r1",
+		},
+		{
+			name: "nested branches are kept",
+			steps: []branchStep{
+				{index: 4, content: "q2"},
+				{index: 2, content: "q1"},
+				{index: 2, branch: 0},
+			},
+			path:     "p0 | a0 | p1 | a1 | q2 | re: q2",
+			branches: "2:0/2 p1*, 2:1/2 q1, 4:0/2 p2, 4:1/2 q2*",
+		},
+		{
+			name:     "edit covered by the summary",
+			steps:    []branchStep{{index: 2, content: "q1"}},
+			covers:   4,
+			path:     "p0 | a0 | q1 | re: q1",
+			branches: "2:0/2 p1, 2:1/2 q1*",
+		},
+		{
+			name:     "edit after the summary",
+			steps:    []branchStep{{index: 2, content: "q1"}},
+			covers:   2,
+			path:     "p0 | a0 | q1 | re: q1",
+			branches: "2:0/2 p1, 2:1/2 q1*",
+			summary:  2,
+		},
+		{
+			name:     "switch covered by the summary",
+			steps:    []branchStep{{index: 4, content: "q2"}, {index: 4, branch: 0}},
+			covers:   6,
+			path:     "p0 | a0 | p1 | a1 | p2 | a2",
+			branches: "4:0/2 p2*, 4:1/2 q2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, repo := newTestHandler(t, echoLLM{})
+			ctx := context.Background()
+			conv := &internal.Conversation{ChatID: "chat", Title: "test", Renamed: true}
+			for i := 0; i < 3; i++ {
+				conv.Messages = append(conv.Messages,
+					&internal.Message{ChatID: conv.ChatID, Role: internal.RoleUser, Content: fmt.Sprintf("p%d", i)},
+					&internal.Message{ChatID: conv.ChatID, Role: "echo", Content: fmt.Sprintf("a%d", i)},
+				)
+			}
+			if tt.covers > 0 {
+				conv.Summary = &internal.Summary{Covers: tt.covers, Content: "summary"}
+			}
+			if err := repo.SaveConversation(ctx, conv); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, step := range tt.steps {
+				var err error
+				if len(step.content) != 0 {
+					err = h.EditPrompt(ctx, conv.ChatID, step.index, io.Discard, step.content)
+				} else {
+					err = h.SwitchBranch(ctx, conv.ChatID, step.index, step.branch)
+				}
+				if err != nil {
+					t.Fatalf("step %+v: %v", step, err)
+				}
+			}
+
+			if got := strings.Join(saved(t, repo, conv.ChatID), " | "); got != pathOf(tt.path) {
+				t.Errorf("path %s, want %s", got, pathOf(tt.path))
+			}
+			branches, err := h.ListBranches(ctx, conv.ChatID)
+			if err != nil {
+				t.Fatalf("ListBranches: %v", err)
+			}
+			var listed []string
+			for _, branch := range branches {
+				s := fmt.Sprintf("%d:%d/%d %s", branch.Index, branch.Branch, branch.Count, branch.Prompt)
+				if branch.Selected {
+					s += "*"
+				}
+				listed = append(listed, s)
+			}
+			if got := strings.Join(listed, ", "); got != tt.branches {
+				t.Errorf("branches %s, want %s", got, tt.branches)
+			}
+
+			stored, err := repo.GetConversationByChatID(ctx, conv.ChatID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			summary := 0
+			if stored.Summary != nil {
+				summary = stored.Summary.Covers
+			}
+			if summary != tt.summary {
+				t.Errorf("summary covers %d, want %d", summary, tt.summary)
+			}
+		})
+	}
+}
+
+// pathOf adds the roles to the contents of a path like saved returns them.
+func pathOf(path string) string {
+	contents := strings.Split(path, " | ")
+	for i, content := range contents {
+		role := "echo"
+		if i%2 == 0 {
+			role = internal.RoleUser
+		}
+		contents[i] = role + ": " + content
+	}
+	return strings.Join(contents, " | ")
+}
+
+func TestSwitchBranchInvalid(t *testing.T) {
+	h, _ := newTestHandler(t, echoLLM{})
+	ctx := context.Background()
+	chatID := createConversation(t, h)
+	if err := h.Talk(ctx, chatID, io.Discard, "p0"); err != nil {
+		t.Fatalf("Talk: %v", err)
+	}
+
+	for _, step := range []branchStep{{index: 1}, {index: 2}, {index: 0, branch: 1}, {index: 0, branch: -1}} {
+		if err := h.SwitchBranch(ctx, chatID, step.index, step.branch); err == nil {
+			t.Errorf("SwitchBranch(%d, %d) succeeded", step.index, step.branch)
+		}
+	}
+	if err := h.EditPrompt(ctx, chatID, 1, io.Discard, "an answer"); err == nil {
+		t.Error("an answer is edited like a prompt")
+	}
+}
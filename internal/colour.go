@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters"
+	"github.com/gdamore/tcell/v2/terminfo"
+)
+
+// ColourMode is the number of colours messages are rendered with.
+type ColourMode string
+
+const (
+	// ColourAuto detects the mode of the terminal, see DetectColourMode.
+	ColourAuto ColourMode = "auto"
+	ColourTrue ColourMode = "truecolor"
+	Colour256  ColourMode = "256"
+	Colour16   ColourMode = "16"
+	// ColourNone renders plain text without any escape sequences.
+	ColourNone ColourMode = "none"
+)
+
+// ParseColourMode parses the name of a ColourMode.
+func ParseColourMode(name string) (ColourMode, error) {
+	switch mode := ColourMode(strings.ToLower(name)); mode {
+	case ColourAuto, ColourTrue, Colour256, Colour16, ColourNone:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown colour mode %q, it is one of auto, truecolor, 256, 16 and none", name)
+}
+
+// DetectColourMode detects the colours the terminal shows. NO_COLOR turns the
+// colours off, COLORTERM tells if the terminal supports true colour, otherwise
+// TERM and its terminfo entry tell the number of colours.
+func DetectColourMode() ColourMode {
+	if len(os.Getenv("NO_COLOR")) != 0 {
+		return ColourNone
+	}
+	switch strings.ToLower(os.Getenv("COLORTERM")) {
+	case "truecolor", "24bit":
+		return ColourTrue
+	}
+
+	term := os.Getenv("TERM")
+	switch {
+	case len(term) == 0 || term == "dumb":
+		return ColourNone
+	case strings.Contains(term, "truecolor") || strings.Contains(term, "direct"):
+		return ColourTrue
+	case strings.Contains(term, "256color"):
+		return Colour256
+	}
+	info, err := terminfo.LookupTerminfo(term)
+	if err != nil {
+		// most terminals show 16 colours at least
+		return Colour16
+	}
+	switch {
+	case info.Colors >= 1<<24:
+		return ColourTrue
+	case info.Colors >= 256:
+		return Colour256
+	case info.Colors >= 8:
+		return Colour16
+	}
+	return ColourNone
+}
+
+// formatter returns the chroma formatter of mode.
+func (mode ColourMode) formatter() chroma.Formatter {
+	name := "terminal256"
+	switch mode {
+	case ColourTrue:
+		name = "terminal16m"
+	case Colour16:
+		name = "terminal16"
+	case ColourNone:
+		name = "noop"
+	}
+	if formatter := formatters.Get(name); formatter != nil {
+		return formatter
+	}
+	return formatters.Fallback
+}
+
+// sgr returns the SGR parameter of the foreground colour closest to c in
+// mode, it is empty if mode has no colours.
+func (mode ColourMode) sgr(c chroma.Colour) string {
+	switch mode {
+	case ColourTrue:
+		return fmt.Sprintf("38;2;%d;%d;%d", c.Red(), c.Green(), c.Blue())
+	case Colour16:
+		return colour16SGR(c)
+	case ColourNone:
+		return ""
+	}
+	return colourSGR(c)
+}
+
+// ansi16 are the RGB values of the 16 ANSI colours as xterm shows them.
+var ansi16 = [16][3]int{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// colour16SGR returns the SGR parameter of the ANSI colour closest to c.
+func colour16SGR(c chroma.Colour) string {
+	r, g, b := int(c.Red()), int(c.Green()), int(c.Blue())
+	closest, best := 0, -1
+	for i, rgb := range ansi16 {
+		d := (r-rgb[0])*(r-rgb[0]) + (g-rgb[1])*(g-rgb[1]) + (b-rgb[2])*(b-rgb[2])
+		if best < 0 || d < best {
+			closest, best = i, d
+		}
+	}
+	if closest < 8 {
+		return fmt.Sprintf("3%d", closest)
+	}
+	return fmt.Sprintf("9%d", closest-8)
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Config is the user configuration read from the config file.
+type Config struct {
+	// Generation holds the generation parameters new conversations start with.
+	Generation GenerationConfig `json:"generation"`
+	// Safety holds the safety settings new conversations start with.
+	Safety []SafetySetting `json:"safety"`
+	// Context sets how histories are fitted into the context window.
+	Context ContextConfig `json:"context"`
+	// Retry sets how failed calls to the providers are retried.
+	Retry RetryConfig `json:"retry"`
+	// Theme is the name of the theme, the dark or light theme is picked for
+	// the terminal if it is empty or "auto".
+	Theme string `json:"theme"`
+}
+
+// GenerationConfig tunes how a LLM generates its answers, the defaults of the
+// model are used for nil fields.
+type GenerationConfig struct {
+	Temperature     *float32 `json:"temperature,omitempty"`
+	TopP            *float32 `json:"top_p,omitempty"`
+	TopK            *int32   `json:"top_k,omitempty"`
+	MaxOutputTokens *int32   `json:"max_output_tokens,omitempty"`
+	StopSequences   []string `json:"stop_sequences,omitempty"`
+	// CandidateCount asks for several answers at once, the extra answers are
+	// kept as alternatives. Only Gemini supports it.
+	CandidateCount *int32 `json:"candidate_count,omitempty"`
+}
+
+// Clone returns a deep copy of gc.
+func (gc GenerationConfig) Clone() GenerationConfig {
+	clone := GenerationConfig{
+		Temperature:     clonePtr(gc.Temperature),
+		TopP:            clonePtr(gc.TopP),
+		TopK:            clonePtr(gc.TopK),
+		MaxOutputTokens: clonePtr(gc.MaxOutputTokens),
+		CandidateCount:  clonePtr(gc.CandidateCount),
+	}
+	if gc.StopSequences != nil {
+		clone.StopSequences = append([]string(nil), gc.StopSequences...)
+	}
+	return clone
+}
+
+// Merge returns a copy of gc whose fields are replaced by the fields set in over.
+func (gc GenerationConfig) Merge(over GenerationConfig) GenerationConfig {
+	merged := gc.Clone()
+	over = over.Clone()
+	if over.Temperature != nil {
+		merged.Temperature = over.Temperature
+	}
+	if over.TopP != nil {
+		merged.TopP = over.TopP
+	}
+	if over.TopK != nil {
+		merged.TopK = over.TopK
+	}
+	if over.MaxOutputTokens != nil {
+		merged.MaxOutputTokens = over.MaxOutputTokens
+	}
+	if over.StopSequences != nil {
+		merged.StopSequences = over.StopSequences
+	}
+	if over.CandidateCount != nil {
+		merged.CandidateCount = over.CandidateCount
+	}
+	return merged
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// LoadConfig reads the config file at path, an empty Config is returned if
+// the file doesn't exist.
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ningzio/geminal/tui"
+)
+
+// ForkConversation implements tui.Backend.
+//
+// The fork keeps the first upTo messages of the selected path with their
+// branches and alternatives, all of them if upTo is not positive. A prompt
+// keeps its answer. The fork gets its own ChatID, so it talks in a session of
+// its own.
+func (h *Handler) ForkConversation(ctx context.Context, chatID string, upTo int) (*tui.Conversation, error) {
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if upTo > len(conv.Messages) {
+		return nil, fmt.Errorf("the conversation has only %d messages", len(conv.Messages))
+	}
+
+	// a copy through JSON is as deep as what the repository keeps
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return nil, fmt.Errorf("fork conversation: %w", err)
+	}
+	fork := &Conversation{}
+	if err := json.Unmarshal(data, fork); err != nil {
+		return nil, fmt.Errorf("fork conversation: %w", err)
+	}
+
+	fork.ChatID = uuid.NewString()
+	fork.Title = conv.Title + " (fork)"
+	fork.StartTime = time.Now()
+	fork.UpdatedTime = time.Now()
+	if upTo > 0 {
+		for upTo < len(fork.Messages) && fork.Messages[upTo].Role != RoleUser {
+			upTo++
+		}
+		fork.Messages = fork.Messages[:upTo]
+		if fork.Summary != nil && fork.Summary.Covers > upTo {
+			fork.Summary = nil
+		}
+	}
+	setChatID(fork.Messages, fork.ChatID)
+
+	if err := h.repo.SaveConversation(ctx, fork); err != nil {
+		return nil, err
+	}
+	return h.GetConversation(ctx, fork.ChatID)
+}
+
+// setChatID moves messages and their branches to the conversation chatID.
+func setChatID(messages []*Message, chatID string) {
+	for _, msg := range messages {
+		msg.ChatID = chatID
+		for _, branch := range msg.Branches {
+			setChatID(branch.Messages, chatID)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package internal
 
 import (
-	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,6 +15,18 @@ import (
 
 type Renderer interface {
 	RenderMessage(writer io.Writer, message *Message)
+	// RenderStream 负责渲染一条流式输出的消息, message 中只有 Role 等元信息,
+	// 内容会通过返回的 writer 分块写入, 写入完成后需要调用 Close
+	RenderStream(writer io.Writer, message *Message) io.WriteCloser
+	// RenderMeta 负责渲染消息的错误信息和 Meta, 例如被拦截或被截断的提示以及引用来源.
+	// RenderMessage 已经包含了这部分内容, 流式输出的消息需要在结束后单独渲染
+	RenderMeta(writer io.Writer, message *Message)
+	// RenderNotice 负责渲染一条不属于任何消息的状态提示, 例如正在重试
+	RenderNotice(writer io.Writer, notice string)
+	// WithWidth 返回一个按 width 列排版的 Renderer
+	WithWidth(width int) Renderer
+	// WithStyle 返回一个使用 chroma 样式 style 着色的 Renderer
+	WithStyle(style string) Renderer
 }
 
 type Repository interface {
@@ -23,14 +38,65 @@ type Repository interface {
 	SaveConversation(ctx context.Context, conversation *Conversation) error
 	// DeleteConversation 负责删除历史聊天记录
 	DeleteConversation(ctx context.Context, chatID string) error
+
+	// ListPersonas 负责加载所有的 persona
+	ListPersonas(ctx context.Context) ([]*Persona, error)
+	// GetPersona 负责根据名字获取 persona
+	GetPersona(ctx context.Context, name string) (*Persona, error)
+	// SavePersona 负责保存 persona
+	SavePersona(ctx context.Context, persona *Persona) error
+	// DeletePersona 负责删除 persona
+	DeletePersona(ctx context.Context, name string) error
+
+	// SaveAttachment 负责按 digest 保存附件内容
+	SaveAttachment(ctx context.Context, digest string, data []byte) error
+	// LoadAttachment 负责根据 digest 加载附件内容
+	LoadAttachment(ctx context.Context, digest string) ([]byte, error)
 }
 
 type LLM interface {
 	Name() string
 	NewSession(ctx context.Context, chatID string, history ...*Message) error
-	Talk(ctx context.Context, chatID string, history []*Message, messages ...*Message) (*Message, error)
+	Talk(ctx context.Context, chatID string, opts Options, history []*Message, messages ...*Message) (*Message, error)
+}
+
+// StreamLLM is a LLM which is able to send its answer piece by piece.
+type StreamLLM interface {
+	LLM
+	// TalkStream works like Talk, but writes the answer to writer while it is
+	// being generated. The returned message holds the complete answer.
+	TalkStream(ctx context.Context, chatID string, opts Options, history []*Message, writer io.Writer, messages ...*Message) (*Message, error)
+}
+
+// ModelLister is a LLM which is able to tell the models it can talk to.
+type ModelLister interface {
+	Models(ctx context.Context) ([]string, error)
 }
 
+// SessionDropper is a LLM which keeps a session per conversation, the session
+// of a deleted conversation must be dropped.
+type SessionDropper interface {
+	DropSession(chatID string)
+}
+
+// Options are the settings of a conversation a LLM applies to a call.
+type Options struct {
+	// Model is the model to talk to, the LLM uses its default model if it is empty.
+	Model      string
+	Generation GenerationConfig
+	// SystemPrompt is a standing instruction which precedes the history.
+	SystemPrompt string
+	Safety       []SafetySetting
+}
+
+const (
+	// RoleUser is the role of the messages written by the user, the messages
+	// answered by a LLM have the name of the LLM as role.
+	RoleUser = "You"
+	// RoleSystem is the role of the instructions given to a LLM.
+	RoleSystem = "System"
+)
+
 // Conversation represent a conversation between user and AI
 type Conversation struct {
 	ChatID      string
@@ -38,67 +104,371 @@ type Conversation struct {
 	Messages    []*Message
 	StartTime   time.Time
 	UpdatedTime time.Time
+	// Provider and Model answer the conversation, the default of the
+	// registry is used if they are empty.
+	Provider string
+	Model    string
+	// Generation holds the generation parameters of the conversation
+	Generation GenerationConfig
+	// Renamed tells that the user gave the conversation its title, an
+	// automatic title never replaces it.
+	Renamed bool `json:",omitempty"`
+	// Persona is the name of the persona the conversation was created with,
+	// its system prompt is copied to SystemPrompt.
+	Persona      string
+	SystemPrompt string
+	// Safety overrides the default safety settings of the model
+	Safety []SafetySetting
+	// Summary replaces the oldest messages when the history is summarized
+	// to fit into the context window.
+	Summary *Summary `json:",omitempty"`
 }
 
-func newConversation() *Conversation {
+func newConversation(provider, model string, config *Config) *Conversation {
 	return &Conversation{
 		ChatID:      uuid.NewString(),
-		Title:       "Untitled",
+		Title:       defaultTitle,
 		StartTime:   time.Now(),
 		UpdatedTime: time.Now(),
+		Provider:    provider,
+		Model:       model,
+		Generation:  config.Generation.Clone(),
+		Safety:      append([]SafetySetting(nil), config.Safety...),
 	}
 }
 
+// options returns the options of conv for a LLM call.
+func (conv *Conversation) options(model string) Options {
+	return Options{
+		Model:        model,
+		Generation:   conv.Generation,
+		SystemPrompt: conv.SystemPrompt,
+		Safety:       conv.Safety,
+	}
+}
+
+// content types of messages
+const (
+	ContentTypeText = "text"
+	// ContentTypeMultipart is the content type of messages with attachments
+	ContentTypeMultipart = "multipart"
+)
+
 type Message struct {
+	// ID identifies the message, messages saved before IDs existed get one
+	// when their conversation is saved again.
+	ID          string `json:",omitempty"`
 	ChatID      string
 	Role        string
 	ContentType string
 	Content     string
-	ErrMsg      string
+	// ErrMsg is the error of a failed answer, see Failed
+	ErrMsg string
+	// Meta is set on answers whose LLM reports more than the content
+	Meta        *ResponseMeta `json:",omitempty"`
+	Attachments []*Attachment `json:",omitempty"`
+	// Tokens is the number of tokens of the message, counted by its LLM
+	Tokens int `json:",omitempty"`
+	// Pinned messages are kept in the history by the pinned strategy
+	Pinned bool `json:",omitempty"`
+	// Alternatives are the answers to the same prompt, Selected is the one
+	// the message shows. A LLM returns its extra candidates in Alternatives.
+	Alternatives []*Alternative `json:",omitempty"`
+	Selected     int            `json:",omitempty"`
+	// Branches are the continuations next to the one starting with this
+	// prompt, see Branch. BranchIndex is the position of this one among them.
+	Branches    []*Branch `json:",omitempty"`
+	BranchIndex int       `json:",omitempty"`
+
+	CreatedAt time.Time
+	// Provider and Model produced an answer, Latency is the time it took.
+	Provider string        `json:",omitempty"`
+	Model    string        `json:",omitempty"`
+	Latency  time.Duration `json:",omitempty"`
+	// PromptTokens is the size of the request of an answer and ResponseTokens
+	// the size of the answer, as reported by the LLM or counted by the handler.
+	PromptTokens   int `json:",omitempty"`
+	ResponseTokens int `json:",omitempty"`
+}
+
+// Failed tells that msg is the answer of a call which failed, ErrMsg holds the error.
+func (msg *Message) Failed() bool {
+	return msg.Role != RoleUser && len(msg.ErrMsg) != 0
+}
+
+// assignIDs gives the messages saved before messages had IDs an ID.
+func assignIDs(messages []*Message) {
+	for _, msg := range messages {
+		if len(msg.ID) == 0 {
+			msg.ID = uuid.NewString()
+		}
+		for _, branch := range msg.Branches {
+			assignIDs(branch.Messages)
+		}
+	}
+}
+
+// newPrompt creates a message of the user in the conversation chatID.
+func newPrompt(chatID, content string) *Message {
+	return &Message{
+		ID:          uuid.NewString(),
+		ChatID:      chatID,
+		Role:        RoleUser,
+		ContentType: ContentTypeText,
+		Content:     content,
+		CreatedAt:   time.Now(),
+	}
 }
 
 var _ tui.Backend = (*Handler)(nil)
 
-func NewHandler(llm LLM, repo Repository, render Renderer) *Handler {
-	return &Handler{
-		llm:    llm,
-		repo:   repo,
-		render: render,
+func NewHandler(registry *Registry, repo Repository, render Renderer, config *Config) *Handler {
+	h := &Handler{
+		registry: registry,
+		repo:     repo,
+		render:   render,
+		config:   config,
+		themes:   make(map[string]*Theme, len(builtinThemes)),
 	}
+	for name, theme := range builtinThemes {
+		h.themes[name] = theme
+	}
+	h.selectTheme()
+	return h
 }
 
 type Handler struct {
-	render Renderer
-	repo   Repository
-	llm    LLM
+	render   Renderer
+	repo     Repository
+	registry *Registry
+	config   *Config
+
+	// mu guards onTitle and the saves which may run next to a Talk
+	mu      sync.Mutex
+	onTitle func(chatID, title string)
+	// deleted holds the chat ids of the deleted conversations, a request which
+	// was still running when its conversation was deleted must not save it
+	deleted map[string]bool
+
+	// themeMu guards render, which changes with the theme, and the themes
+	themeMu sync.Mutex
+	themes  map[string]*Theme
+	theme   *Theme
+
+	// busy holds the chat ids of the conversations a request is changing
+	busyMu sync.Mutex
+	busy   map[string]bool
+}
+
+// ErrBusy is returned by a request on a conversation which is still answering
+// an earlier one.
+var ErrBusy = errors.New("an answer is in progress, wait for it or cancel it with Esc")
+
+// SetupError is a failure of a LLM call which fails again until the user
+// changes the setup of the provider, e.g. pulls a missing model. Besides being
+// kept as the failed answer, it is returned to be shown to the user.
+type SetupError struct {
+	Err error
+}
+
+func (e *SetupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// reported returns err if the user should see it besides the failed answer
+// which keeps it, nil otherwise.
+func reported(err error) error {
+	var setup *SetupError
+	if errors.As(err, &setup) {
+		return err
+	}
+	return nil
+}
+
+// lock marks the conversation chatID busy for a request which changes it, the
+// request fails with ErrBusy if another one is changing the conversation.
+// Requests on different conversations run in parallel. unlock must be called
+// once the request is done.
+func (h *Handler) lock(chatID string) (unlock func(), err error) {
+	h.busyMu.Lock()
+	defer h.busyMu.Unlock()
+	if h.busy[chatID] {
+		return nil, ErrBusy
+	}
+	if h.busy == nil {
+		h.busy = make(map[string]bool)
+	}
+	h.busy[chatID] = true
+	return func() {
+		h.busyMu.Lock()
+		defer h.busyMu.Unlock()
+		delete(h.busy, chatID)
+	}, nil
 }
 
 // DeleteConversation implements tui.Backend.
+//
+// The conversation is deleted even if a request is still changing it, the
+// request should be cancelled, its later saves are skipped.
 func (h *Handler) DeleteConversation(ctx context.Context, chatID string) error {
-	return h.repo.DeleteConversation(ctx, chatID)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.repo.DeleteConversation(ctx, chatID); err != nil {
+		return err
+	}
+	if h.deleted == nil {
+		h.deleted = make(map[string]bool)
+	}
+	h.deleted[chatID] = true
+	h.dropSessions(chatID)
+	return nil
+}
+
+// dropSessions drops the sessions of chatID, which have to be recreated when
+// the conversation is deleted or its history changed.
+func (h *Handler) dropSessions(chatID string) {
+	// the conversation may have talked to several providers
+	for _, llm := range h.registry.LLMs() {
+		if dropper, ok := llm.(SessionDropper); ok {
+			dropper.DropSession(chatID)
+		}
+	}
 }
 
 // UpdateConversation implements tui.Backend.
+//
+// The title is changed under mu like the title of autoTitle, so the rename
+// doesn't write back a stale copy of a conversation which is answering, the
+// answer keeps the new title when it is saved, see saveConversation.
 func (h *Handler) UpdateConversation(ctx context.Context, chatID string, title string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
 	if err != nil {
 		return err
 	}
 	conv.Title = title
+	conv.Renamed = true
+	conv.UpdatedTime = time.Now()
 	return h.repo.SaveConversation(ctx, conv)
 }
 
 // CreateConversation implements tui.Handler.
-func (h *Handler) CreateConversation(ctx context.Context) (*tui.Conversation, error) {
-	conv := newConversation()
+func (h *Handler) CreateConversation(ctx context.Context, persona string) (*tui.Conversation, error) {
+	provider, model := h.registry.Default()
+	conv := newConversation(provider, model, h.config)
+	if len(persona) != 0 {
+		p, err := h.repo.GetPersona(ctx, persona)
+		if err != nil {
+			return nil, err
+		}
+		conv.Persona = p.Name
+		conv.SystemPrompt = p.SystemPrompt
+		if len(p.Provider) != 0 {
+			conv.Provider, conv.Model = p.Provider, p.Model
+		}
+		conv.Generation = conv.Generation.Merge(p.Generation)
+	}
 	if err := h.repo.SaveConversation(ctx, conv); err != nil {
 		return nil, err
 	}
-	return &tui.Conversation{
-		ChatID:  conv.ChatID,
-		Title:   conv.Title,
-		Content: nil,
-	}, nil
+	return h.conversation(conv), nil
+}
+
+// GetSettings implements tui.Backend.
+func (h *Handler) GetSettings(ctx context.Context, chatID string) (*tui.Settings, error) {
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	gc := conv.Generation.Clone()
+	settings := &tui.Settings{
+		Temperature:      gc.Temperature,
+		TopP:             gc.TopP,
+		TopK:             gc.TopK,
+		MaxOutputTokens:  gc.MaxOutputTokens,
+		StopSequences:    gc.StopSequences,
+		CandidateCount:   gc.CandidateCount,
+		Safety:           make(map[string]string, len(conv.Safety)),
+		SafetyCategories: HarmCategories,
+		SafetyThresholds: BlockThresholds,
+	}
+	for _, s := range conv.Safety {
+		settings.Safety[s.Category] = s.Threshold
+	}
+	return settings, nil
+}
+
+// UpdateSettings implements tui.Backend.
+func (h *Handler) UpdateSettings(ctx context.Context, chatID string, settings *tui.Settings) error {
+	unlock, err := h.lock(chatID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	conv.Generation = GenerationConfig{
+		Temperature:     settings.Temperature,
+		TopP:            settings.TopP,
+		TopK:            settings.TopK,
+		MaxOutputTokens: settings.MaxOutputTokens,
+		StopSequences:   settings.StopSequences,
+		CandidateCount:  settings.CandidateCount,
+	}.Clone()
+	conv.Safety = nil
+	for _, category := range HarmCategories {
+		if threshold, ok := settings.Safety[category]; ok {
+			conv.Safety = append(conv.Safety, SafetySetting{Category: category, Threshold: threshold})
+		}
+	}
+	return h.saveConversation(ctx, conv)
+}
+
+// ListModels implements tui.Backend.
+func (h *Handler) ListModels(ctx context.Context) ([]*tui.Model, error) {
+	models, err := h.registry.Models(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*tui.Model, 0, len(models))
+	for _, m := range models {
+		result = append(result, &tui.Model{Provider: m.Provider, Name: m.Name})
+	}
+	return result, nil
+}
+
+// SetModel implements tui.Backend.
+//
+// The model becomes the default of new conversations, and the model of the
+// conversation chatID if it is not empty.
+func (h *Handler) SetModel(ctx context.Context, chatID, provider, model string) error {
+	if err := h.registry.SetDefault(provider, model); err != nil {
+		return err
+	}
+	if len(chatID) == 0 {
+		return nil
+	}
+	unlock, err := h.lock(chatID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	conv.Provider = provider
+	conv.Model = model
+	return h.saveConversation(ctx, conv)
 }
 
 // GetConversation implements tui.Handler.
@@ -107,19 +477,68 @@ func (h *Handler) GetConversation(ctx context.Context, chatID string) (*tui.Conv
 	if err != nil {
 		return nil, err
 	}
-	result := &tui.Conversation{
-		ChatID: conv.ChatID,
-		Title:  conv.Title,
+	return h.conversation(conv), nil
+}
+
+// ExportConversation renders the conversation whose chat id or title is name
+// to writer, the most recent one is taken if several have the title.
+func (h *Handler) ExportConversation(ctx context.Context, name string, writer io.Writer) error {
+	convs, err := h.repo.LoadHistory(ctx)
+	if err != nil {
+		return err
 	}
+	var found *Conversation
+	for _, conv := range convs {
+		if conv.ChatID == name {
+			found = conv
+			break
+		}
+		if conv.Title == name && (found == nil || conv.UpdatedTime.After(found.UpdatedTime)) {
+			found = conv
+		}
+	}
+	if found == nil {
+		return errors.New("conversation not found: " + name)
+	}
+	h.conversation(found).Render(writer, 0)
+	return nil
+}
 
-	buf := bytes.Buffer{}
+// conversation converts conv to a tui.Conversation, its messages are rendered
+// when the chat view shows them.
+func (h *Handler) conversation(conv *Conversation) *tui.Conversation {
+	return &tui.Conversation{
+		ChatID:   conv.ChatID,
+		Title:    conv.Title,
+		Provider: conv.Provider,
+		Model:    conv.Model,
+		Render: func(writer io.Writer, width int) {
+			render := h.baseRenderer()
+			if width > 0 {
+				render = render.WithWidth(width)
+			}
+			for _, msg := range conv.Messages {
+				render.RenderMessage(writer, msg)
+			}
+		},
+	}
+}
 
-	for _, msg := range conv.Messages {
-		h.render.RenderMessage(&buf, msg)
+// renderer returns the Renderer for writer, which lays out messages in the
+// width of writer if it knows its width.
+func (h *Handler) renderer(writer io.Writer) Renderer {
+	render := h.baseRenderer()
+	if w, ok := writer.(tui.WidthWriter); ok && w.Width() > 0 {
+		return render.WithWidth(w.Width())
 	}
+	return render
+}
 
-	result.Content = buf.Bytes()
-	return result, nil
+// baseRenderer returns the Renderer of the current theme.
+func (h *Handler) baseRenderer() Renderer {
+	h.themeMu.Lock()
+	defer h.themeMu.Unlock()
+	return h.render
 }
 
 // ListConversation implements tui.Handler.
@@ -131,46 +550,218 @@ func (h *Handler) ListConversation(ctx context.Context) ([]*tui.Conversation, er
 	result := make([]*tui.Conversation, 0, len(conversations))
 
 	for _, conv := range conversations {
-		c := &tui.Conversation{
-			ChatID: conv.ChatID,
-			Title:  conv.Title,
-		}
-
-		buf := bytes.Buffer{}
-
-		for _, msg := range conv.Messages {
-			h.render.RenderMessage(&buf, msg)
-		}
-
-		c.Content = buf.Bytes()
-		result = append(result, c)
+		result = append(result, h.conversation(conv))
 	}
 	return result, nil
 }
 
-func (h *Handler) Talk(ctx context.Context, chatID string, writer io.Writer, prompt string) error {
+// Talk implements tui.Backend.
+//
+// The files at attachments are sent together with prompt.
+func (h *Handler) Talk(ctx context.Context, chatID string, writer io.Writer, prompt string, attachments ...string) error {
+	unlock, err := h.lock(chatID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
 	if err != nil {
 		return err
 	}
 
-	message := &Message{
-		ChatID:      chatID,
-		Role:        "You",
-		ContentType: "text",
-		Content:     prompt,
+	message := newPrompt(chatID, prompt)
+	if err := h.attach(ctx, message, attachments); err != nil {
+		return err
 	}
-	h.render.RenderMessage(writer, message)
+	if err := h.loadAttachments(ctx, conv.Messages); err != nil {
+		return err
+	}
+	h.renderer(writer).RenderMessage(writer, message)
 
-	result, err := h.llm.Talk(ctx, chatID, conv.Messages, message)
+	llm, model, err := h.registry.Resolve(conv.Provider, conv.Model)
 	if err != nil {
 		return err
 	}
+	countTokens(ctx, llm, model, message)
+	history := h.fitHistory(ctx, conv, llm, model, message)
 
-	h.render.RenderMessage(writer, result)
-
+	// the prompt is saved before the call, so it survives a failed call or a crash
 	conv.Messages = append(conv.Messages, message)
+	if err := h.saveConversation(ctx, conv); err != nil {
+		return err
+	}
+
+	result, talkErr := h.talk(ctx, conv, llm, conv.options(model), history, writer, message)
+	if talkErr != nil {
+		// the failure is shown as the answer and kept with the conversation
+		log.Printf("talk to %s in %s: %v", llm.Name(), chatID, talkErr)
+	}
 	conv.Messages = append(conv.Messages, result)
+	if err := h.saveConversation(ctx, conv); err != nil {
+		return err
+	}
+
+	if len(conv.Messages) == 2 && !result.Failed() && !conv.Renamed && conv.Title == defaultTitle {
+		go h.autoTitle(chatID, llm, model, message)
+	}
+	return reported(talkErr)
+}
+
+// saveConversation saves conv as updated now, keeping the title which was
+// saved while conv was loaded, e.g. by UpdateConversation or the title of
+// autoTitle. A conversation which was deleted meanwhile is not saved again.
+func (h *Handler) saveConversation(ctx context.Context, conv *Conversation) error {
+	conv.UpdatedTime = time.Now()
+	assignIDs(conv.Messages)
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.deleted[conv.ChatID] {
+		return nil
+	}
+	if stored, err := h.repo.GetConversationByChatID(ctx, conv.ChatID); err == nil {
+		conv.Title, conv.Renamed = stored.Title, stored.Renamed
+	}
 	return h.repo.SaveConversation(ctx, conv)
 }
+
+// cancelledMarker is appended to an answer whose request was cancelled by the user.
+const cancelledMarker = "*(cancelled)*"
+
+// talk sends message with history to llm and renders the answer to writer, the
+// answer is streamed if llm supports it. If ctx is cancelled, talk returns the
+// partial answer with a cancelled marker instead of an error. The answer is
+// completed with its metadata, see finish. If the call fails, talk renders and
+// returns a failed answer together with the error. Failed and unanswered
+// prompts of history are left out of the call.
+func (h *Handler) talk(ctx context.Context, conv *Conversation, llm LLM, opts Options, history []*Message, writer io.Writer, message *Message) (*Message, error) {
+	render := h.renderer(writer)
+	started := time.Now()
+	// the prompt tokens are estimated from the history which is sent
+	history = answered(history)
+	result, streamed, err := h.send(ctx, conv, llm, opts, history, writer, message)
+	if err != nil {
+		result = failed(conv.ChatID, llm, opts.Model, err, started)
+		if streamed {
+			render.RenderMeta(writer, result)
+		} else {
+			render.RenderMessage(writer, result)
+		}
+		return result, err
+	}
+	h.finish(ctx, llm, opts, history, message, result, started)
+	if streamed {
+		render.RenderMeta(writer, result)
+	} else {
+		render.RenderMessage(writer, result)
+	}
+	return result, nil
+}
+
+// finish fills in the metadata of the answer result which llm started to
+// give at started, and collects its alternatives.
+func (h *Handler) finish(ctx context.Context, llm LLM, opts Options, history []*Message, message, result *Message, started time.Time) {
+	result.ID = uuid.NewString()
+	result.CreatedAt = time.Now()
+	result.Provider = llm.Name()
+	result.Model = opts.Model
+	result.Latency = time.Since(started)
+
+	countTokens(ctx, llm, opts.Model, result)
+	if result.PromptTokens == 0 {
+		result.PromptTokens = messageTokens(message) + EstimateTokens(opts.SystemPrompt)
+		for _, msg := range history {
+			result.PromptTokens += messageTokens(msg)
+		}
+	}
+	if result.ResponseTokens == 0 {
+		result.ResponseTokens = result.Tokens
+	}
+	collectAlternatives(result)
+}
+
+// send sends message to llm and streams the answer to writer if llm supports
+// it, streamed tells whether it did. See talk.
+func (h *Handler) send(ctx context.Context, conv *Conversation, llm LLM, opts Options, history []*Message, writer io.Writer, message *Message) (result *Message, streamed bool, err error) {
+	render := h.renderer(writer)
+	ctx = WithRetryNotify(ctx, func(r Retry) {
+		render.RenderNotice(writer, fmt.Sprintf("retrying (%d/%d) in %s: %v", r.Attempt, r.MaxAttempts, r.Delay.Round(100*time.Millisecond), r.Err))
+	})
+
+	streamer, ok := llm.(StreamLLM)
+	if count := opts.Generation.CandidateCount; count != nil && *count > 1 {
+		// several candidates can't be streamed
+		ok = false
+	}
+	if !ok {
+		result, err := llm.Talk(ctx, conv.ChatID, opts, history, message)
+		if err != nil {
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				return nil, false, err
+			}
+			result = cancelled(conv.ChatID, llm, nil)
+		}
+		return result, false, nil
+	}
+
+	stream := render.RenderStream(writer, &Message{ChatID: conv.ChatID, Role: llm.Name()})
+	result, err = streamer.TalkStream(ctx, conv.ChatID, opts, history, stream, message)
+	if err != nil {
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			_ = stream.Close()
+			return nil, true, err
+		}
+		result = cancelled(conv.ChatID, llm, result)
+		if result.Content == cancelledMarker {
+			_, _ = io.WriteString(stream, cancelledMarker)
+		} else {
+			_, _ = io.WriteString(stream, "\n\n"+cancelledMarker)
+		}
+	}
+	_ = stream.Close()
+	return result, true, nil
+}
+
+// failed returns the answer of llm to a call which failed with err, the
+// answer has no content and holds the error.
+func failed(chatID string, llm LLM, model string, err error, started time.Time) *Message {
+	return &Message{
+		ID:          uuid.NewString(),
+		ChatID:      chatID,
+		Role:        llm.Name(),
+		ContentType: ContentTypeText,
+		ErrMsg:      err.Error(),
+		CreatedAt:   time.Now(),
+		Provider:    llm.Name(),
+		Model:       model,
+		Latency:     time.Since(started),
+	}
+}
+
+// answered returns the turns of history which got an answer, failed and
+// unanswered prompts are not sent to a LLM.
+func answered(history []*Message) []*Message {
+	var result []*Message
+	for _, turn := range splitTurns(history) {
+		last := turn[len(turn)-1]
+		if last.Role == RoleUser || last.Failed() {
+			continue
+		}
+		result = append(result, turn...)
+	}
+	return result
+}
+
+// cancelled appends the cancelled marker to the partial answer of llm, partial may be nil.
+func cancelled(chatID string, llm LLM, partial *Message) *Message {
+	if partial == nil {
+		partial = &Message{ChatID: chatID, Role: llm.Name()}
+	}
+	if len(partial.Content) == 0 {
+		partial.Content = cancelledMarker
+	} else {
+		partial.Content += "\n\n" + cancelledMarker
+	}
+	return partial
+}
@@ -0,0 +1,424 @@
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ningzio/geminal/internal"
+	"github.com/ningzio/geminal/internal/llm"
+)
+
+// memRepository keeps conversations in memory, they are copied in and out
+// like the repository does by storing them as JSON.
+type memRepository struct {
+	mu            sync.Mutex
+	conversations map[string][]byte
+	// stall, if set, is called once by the next GetConversationByChatID after
+	// it read the conversation, so a test can interleave requests
+	stall atomic.Pointer[func()]
+}
+
+var _ internal.Repository = (*memRepository)(nil)
+
+func newMemRepository() *memRepository {
+	return &memRepository{conversations: make(map[string][]byte)}
+}
+
+func (r *memRepository) LoadHistory(ctx context.Context) ([]*internal.Conversation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	history := make([]*internal.Conversation, 0, len(r.conversations))
+	for _, data := range r.conversations {
+		conv := &internal.Conversation{}
+		if err := json.Unmarshal(data, conv); err != nil {
+			return nil, err
+		}
+		history = append(history, conv)
+	}
+	return history, nil
+}
+
+func (r *memRepository) GetConversationByChatID(ctx context.Context, chatID string) (*internal.Conversation, error) {
+	r.mu.Lock()
+	data, ok := r.conversations[chatID]
+	r.mu.Unlock()
+	if stall := r.stall.Swap(nil); stall != nil {
+		(*stall)()
+	}
+	if !ok {
+		return nil, fmt.Errorf("conversation %s not found", chatID)
+	}
+	conv := &internal.Conversation{}
+	return conv, json.Unmarshal(data, conv)
+}
+
+func (r *memRepository) SaveConversation(ctx context.Context, conversation *internal.Conversation) error {
+	data, err := json.Marshal(conversation)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conversations[conversation.ChatID] = data
+	return nil
+}
+
+func (r *memRepository) DeleteConversation(ctx context.Context, chatID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conversations, chatID)
+	return nil
+}
+
+func (*memRepository) ListPersonas(ctx context.Context) ([]*internal.Persona, error) {
+	return nil, nil
+}
+
+func (*memRepository) GetPersona(ctx context.Context, name string) (*internal.Persona, error) {
+	return nil, errors.New("persona not found: " + name)
+}
+
+func (*memRepository) SavePersona(ctx context.Context, persona *internal.Persona) error {
+	return errors.ErrUnsupported
+}
+
+func (*memRepository) DeletePersona(ctx context.Context, name string) error {
+	return errors.ErrUnsupported
+}
+
+func (*memRepository) SaveAttachment(ctx context.Context, digest string, data []byte) error {
+	return errors.ErrUnsupported
+}
+
+func (*memRepository) LoadAttachment(ctx context.Context, digest string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// newTestHandler returns a Handler which talks to ai and keeps its
+// conversations in memory, the messages are rendered without colours.
+func newTestHandler(t *testing.T, ai internal.LLM) (*internal.Handler, *memRepository) {
+	t.Helper()
+	registry := internal.NewRegistry()
+	registry.Register(ai, "test")
+	repo := newMemRepository()
+	return internal.NewHandler(registry, repo, internal.NewMarkdownRenderer(internal.ColourNone), &internal.Config{}), repo
+}
+
+// newTestReplay returns a Replay of the cassette in JSON.
+func newTestReplay(t *testing.T, cassette string) *llm.Replay {
+	t.Helper()
+	c, err := llm.ParseCassette([]byte(cassette))
+	if err != nil {
+		t.Fatalf("ParseCassette: %v", err)
+	}
+	return llm.NewReplay(c)
+}
+
+// createConversation creates a conversation which is renamed, so the LLM
+// isn't asked for a title.
+func createConversation(t *testing.T, h *internal.Handler) string {
+	t.Helper()
+	ctx := context.Background()
+	conv, err := h.CreateConversation(ctx, "")
+	if err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	if err := h.UpdateConversation(ctx, conv.ChatID, "test"); err != nil {
+		t.Fatalf("UpdateConversation: %v", err)
+	}
+	return conv.ChatID
+}
+
+// saved returns the saved messages of chatID as "role: content".
+func saved(t *testing.T, repo *memRepository, chatID string) []string {
+	t.Helper()
+	conv, err := repo.GetConversationByChatID(context.Background(), chatID)
+	if err != nil {
+		t.Fatalf("GetConversationByChatID: %v", err)
+	}
+	var messages []string
+	for _, msg := range conv.Messages {
+		messages = append(messages, msg.Role+": "+msg.Content)
+	}
+	return messages
+}
+
+// startedWriter tells through started when the first chunk is written.
+type startedWriter struct {
+	once    sync.Once
+	started chan struct{}
+}
+
+func newStartedWriter() *startedWriter {
+	return &startedWriter{started: make(chan struct{})}
+}
+
+func (w *startedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	return len(p), nil
+}
+
+// slowCassette streams its answer to "slow" in chunks.
+const slowCassette = `{"interactions": [
+	{"prompt": "slow", "chunks": ["one ", "two ", "three"], "delay_ms": 50}
+]}`
+
+const testCassette = `{
+  "provider": "Replay",
+  "interactions": [
+    {"prompt": "(?i)^hello", "match": "regex", "chunks": ["Hello ", "from ", "the cassette."]},
+    {"prompt": "retry", "error": "rate limited", "status": 429},
+    {"prompt": "retry", "answer": "Answered after a retry."},
+    {"prompt": "broken", "error": "bad request"}
+  ]
+}`
+
+func TestReplayHandler(t *testing.T) {
+	h, repo := newTestHandler(t, internal.NewRetryLLM(newTestReplay(t, testCassette), internal.RetryConfig{BaseDelayMS: 1}))
+	ctx := context.Background()
+	chatID := createConversation(t, h)
+
+	tests := []struct {
+		prompt string
+		// output is a part of the rendered output
+		output string
+		answer string
+		failed bool
+	}{
+		{prompt: "Hello there", output: "Hello from the cassette.", answer: "Hello from the cassette."},
+		{prompt: "retry", output: "retrying (2/5)", answer: "Answered after a retry."},
+		{prompt: "broken", output: "replay: bad request", failed: true},
+		{prompt: "unknown", output: `no recorded answer for "unknown"`, failed: true},
+	}
+	for i, tt := range tests {
+		var output strings.Builder
+		if err := h.Talk(ctx, chatID, &output, tt.prompt); err != nil {
+			t.Fatalf("Talk(%q): %v", tt.prompt, err)
+		}
+		if !strings.Contains(output.String(), tt.output) {
+			t.Errorf("Talk(%q) rendered %q, want %q in it", tt.prompt, output.String(), tt.output)
+		}
+
+		conv, err := repo.GetConversationByChatID(ctx, chatID)
+		if err != nil {
+			t.Fatalf("GetConversationByChatID: %v", err)
+		}
+		if len(conv.Messages) != 2*(i+1) {
+			t.Fatalf("%d messages saved after %q, want %d", len(conv.Messages), tt.prompt, 2*(i+1))
+		}
+		prompt, answer := conv.Messages[2*i], conv.Messages[2*i+1]
+		if prompt.Role != internal.RoleUser || prompt.Content != tt.prompt {
+			t.Errorf("saved prompt %+v, want %q", prompt, tt.prompt)
+		}
+		if answer.Failed() != tt.failed {
+			t.Errorf("answer of %q failed = %v, want %v", tt.prompt, answer.Failed(), tt.failed)
+		}
+		if !tt.failed && (answer.Content != tt.answer || answer.Role != "Replay") {
+			t.Errorf("answer of %q = %s: %q, want %q", tt.prompt, answer.Role, answer.Content, tt.answer)
+		}
+	}
+}
+
+func TestTalkBusy(t *testing.T) {
+	h, repo := newTestHandler(t, newTestReplay(t, slowCassette))
+	chatID := createConversation(t, h)
+
+	writer := newStartedWriter()
+	done := make(chan error)
+	go func() {
+		done <- h.Talk(context.Background(), chatID, writer, "slow")
+	}()
+	<-writer.started
+
+	if err := h.Talk(context.Background(), chatID, io.Discard, "meanwhile"); !errors.Is(err, internal.ErrBusy) {
+		t.Errorf("Talk while answering = %v, want ErrBusy", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Talk: %v", err)
+	}
+
+	want := "[You: slow Replay: one two three]"
+	if got := fmt.Sprint(saved(t, repo, chatID)); got != want {
+		t.Errorf("saved %s, want %s", got, want)
+	}
+	// the conversation answers again once it is done
+	if err := h.Talk(context.Background(), chatID, io.Discard, "slow"); err != nil {
+		t.Errorf("Talk after the answer: %v", err)
+	}
+}
+
+// barrierLLM answers a prompt only once parties calls are in flight, the
+// calls fail if they don't run in parallel.
+type barrierLLM struct {
+	parties int
+
+	mu      sync.Mutex
+	arrived int
+	all     chan struct{}
+}
+
+func (*barrierLLM) Name() string { return "barrier" }
+
+func (*barrierLLM) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+	return nil
+}
+
+func (ai *barrierLLM) Talk(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
+	return ai.TalkStream(ctx, chatID, opts, history, io.Discard, messages...)
+}
+
+func (ai *barrierLLM) TalkStream(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, writer io.Writer, messages ...*internal.Message) (*internal.Message, error) {
+	ai.mu.Lock()
+	ai.arrived++
+	if ai.arrived == ai.parties {
+		close(ai.all)
+	}
+	ai.mu.Unlock()
+
+	select {
+	case <-ai.all:
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("barrier: the calls don't run in parallel")
+	}
+	answer := "answer to " + messages[len(messages)-1].Content
+	io.WriteString(writer, answer)
+	return &internal.Message{ChatID: chatID, Role: ai.Name(), Content: answer}, nil
+}
+
+func TestTalkParallel(t *testing.T) {
+	h, repo := newTestHandler(t, &barrierLLM{parties: 2, all: make(chan struct{})})
+	chats := []string{createConversation(t, h), createConversation(t, h)}
+
+	outputs := make([]strings.Builder, len(chats))
+	var wg sync.WaitGroup
+	for i, chatID := range chats {
+		wg.Add(1)
+		go func(i int, chatID string) {
+			defer wg.Done()
+			if err := h.Talk(context.Background(), chatID, &outputs[i], fmt.Sprintf("prompt %d", i)); err != nil {
+				t.Errorf("Talk in chat %d: %v", i, err)
+			}
+		}(i, chatID)
+	}
+	wg.Wait()
+
+	for i, chatID := range chats {
+		answer, other := fmt.Sprintf("answer to prompt %d", i), fmt.Sprintf("answer to prompt %d", 1-i)
+		if output := outputs[i].String(); !strings.Contains(output, answer) || strings.Contains(output, other) {
+			t.Errorf("chat %d rendered %q, want only %q", i, output, answer)
+		}
+		want := fmt.Sprintf("[You: prompt %d barrier: %s]", i, answer)
+		if got := fmt.Sprint(saved(t, repo, chatID)); got != want {
+			t.Errorf("chat %d saved %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestDeleteWhileAnswering(t *testing.T) {
+	h, repo := newTestHandler(t, newTestReplay(t, slowCassette))
+	chatID := createConversation(t, h)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := newStartedWriter()
+	done := make(chan error)
+	go func() {
+		done <- h.Talk(ctx, chatID, writer, "slow")
+	}()
+	<-writer.started
+
+	// the delete doesn't wait for the answer, which saves after it
+	if err := h.DeleteConversation(context.Background(), chatID); err != nil {
+		t.Fatalf("DeleteConversation while answering: %v", err)
+	}
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatalf("Talk: %v", err)
+	}
+
+	if conv, err := repo.GetConversationByChatID(context.Background(), chatID); err == nil {
+		t.Errorf("the deleted conversation is saved again with %d messages", len(conv.Messages))
+	}
+	if err := h.UpdateConversation(context.Background(), chatID, "renamed"); err == nil {
+		t.Error("a deleted conversation is renamed")
+	}
+}
+
+func TestRenameWhileAnswering(t *testing.T) {
+	h, repo := newTestHandler(t, newTestReplay(t, slowCassette))
+	chatID := createConversation(t, h)
+
+	writer := newStartedWriter()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Talk(context.Background(), chatID, writer, "slow")
+	}()
+	<-writer.started
+
+	// the rename reads the conversation before the answer is saved and saves
+	// it once the answer is done or the answer waits for the rename
+	talked := make(chan error, 1)
+	stall := func() {
+		select {
+		case err := <-done:
+			talked <- err
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	repo.stall.Store(&stall)
+	if err := h.UpdateConversation(context.Background(), chatID, "renamed"); err != nil {
+		t.Fatalf("UpdateConversation while answering: %v", err)
+	}
+	select {
+	case err := <-talked:
+		done <- err
+	default:
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Talk: %v", err)
+	}
+
+	conv, err := repo.GetConversationByChatID(context.Background(), chatID)
+	if err != nil {
+		t.Fatalf("GetConversationByChatID: %v", err)
+	}
+	if conv.Title != "renamed" || !conv.Renamed {
+		t.Errorf("title %q renamed %v, want the new title", conv.Title, conv.Renamed)
+	}
+	want := "[You: slow Replay: one two three]"
+	if got := fmt.Sprint(saved(t, repo, chatID)); got != want {
+		t.Errorf("saved %s, want %s", got, want)
+	}
+}
+
+func TestRegenerateFailed(t *testing.T) {
+	h, repo := newTestHandler(t, newTestReplay(t, `{"interactions": [
+		{"prompt": "hi", "answer": "hello"},
+		{"prompt": "hi", "error": "overloaded"}
+	]}`))
+	chatID := createConversation(t, h)
+	if err := h.Talk(context.Background(), chatID, io.Discard, "hi"); err != nil {
+		t.Fatalf("Talk: %v", err)
+	}
+
+	// the failure is rendered instead of returned
+	var output strings.Builder
+	if err := h.Regenerate(context.Background(), chatID, &output); err != nil {
+		t.Errorf("Regenerate = %v, want the failure only rendered", err)
+	}
+	if !strings.Contains(output.String(), "overloaded") {
+		t.Errorf("Regenerate rendered %q, want the failure", output.String())
+	}
+	want := "[You: hi Replay: hello]"
+	if got := fmt.Sprint(saved(t, repo, chatID)); got != want {
+		t.Errorf("saved %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,36 @@
+package llm
+
+import (
+	"fmt"
+
+	"github.com/ningzio/geminal/internal"
+)
+
+// messageText returns the content of msg followed by the content of its text
+// attachments. Images are left out, a placeholder naming them is added instead
+// if placeholders is true.
+func messageText(msg *internal.Message, placeholders bool) string {
+	text := msg.Content
+	for _, attachment := range msg.Attachments {
+		if attachment.IsImage() {
+			if placeholders {
+				text += fmt.Sprintf("\n\n[image: %s]", attachment.Name)
+			}
+			continue
+		}
+		text += fmt.Sprintf("\n\n%s:\n```\n%s\n```", attachment.Name, attachment.Data)
+	}
+	return text
+}
+
+// hasImages tells whether any of messages has an image attachment.
+func hasImages(messages []*internal.Message) bool {
+	for _, msg := range messages {
+		for _, attachment := range msg.Attachments {
+			if attachment.IsImage() {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,344 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ningzio/geminal/internal"
+)
+
+var (
+	_ internal.StreamLLM      = (*Replay)(nil)
+	_ internal.StreamLLM      = (*Recorder)(nil)
+	_ internal.ModelLister    = (*Recorder)(nil)
+	_ internal.TokenCounter   = (*Recorder)(nil)
+	_ internal.SessionDropper = (*Recorder)(nil)
+)
+
+// match modes of a recorded prompt
+const (
+	MatchExact = "exact"
+	MatchRegex = "regex"
+)
+
+// Cassette is a recorded conversation with a provider, it is stored as JSON.
+type Cassette struct {
+	// Provider is the name the replay answers with.
+	Provider     string         `json:"provider"`
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is a prompt together with the answer or the error it got.
+type Interaction struct {
+	// Prompt is matched against the content of the last message of a call,
+	// as is or as a regular expression if Match is MatchRegex.
+	Prompt string `json:"prompt"`
+	Match  string `json:"match,omitempty"`
+
+	// Chunks are the chunks of a streamed answer, Answer is their concatenation.
+	Answer string                 `json:"answer,omitempty"`
+	Chunks []string               `json:"chunks,omitempty"`
+	Meta   *internal.ResponseMeta `json:"meta,omitempty"`
+	// DelayMS is the delay before every chunk.
+	DelayMS int `json:"delay_ms,omitempty"`
+
+	// Error fails the call, with the HTTP status Status if it is set.
+	Error  string `json:"error,omitempty"`
+	Status int    `json:"status,omitempty"`
+
+	regexp *regexp.Regexp
+}
+
+// matches tells whether prompt is the recorded prompt.
+func (i *Interaction) matches(prompt string) bool {
+	if i.regexp != nil {
+		return i.regexp.MatchString(prompt)
+	}
+	return i.Prompt == prompt
+}
+
+// LoadCassette reads the cassette at path, see ParseCassette.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read cassette: %w", err)
+	}
+	cassette, err := ParseCassette(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse cassette %s: %w", path, err)
+	}
+	return cassette, nil
+}
+
+// ParseCassette decodes the cassette in data and compiles its regular expressions.
+func ParseCassette(data []byte) (*Cassette, error) {
+	cassette := &Cassette{}
+	if err := json.Unmarshal(data, cassette); err != nil {
+		return nil, err
+	}
+	for _, interaction := range cassette.Interactions {
+		switch interaction.Match {
+		case "", MatchExact:
+		case MatchRegex:
+			var err error
+			interaction.regexp, err = regexp.Compile(interaction.Prompt)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown match %q", interaction.Match)
+		}
+	}
+	return cassette, nil
+}
+
+// Save writes c to path.
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode cassette: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("write cassette: %w", err)
+	}
+	return nil
+}
+
+// NewReplay creates a provider which answers with the interactions of cassette.
+func NewReplay(cassette *Cassette) *Replay {
+	return &Replay{
+		cassette: cassette,
+		used:     make(map[*Interaction]bool),
+	}
+}
+
+// Replay answers prompts with the interactions of a cassette, no request leaves
+// the machine. An interaction is replayed once as long as there are unused
+// interactions which match the prompt, the last match is replayed after that.
+type Replay struct {
+	cassette *Cassette
+
+	mu   sync.Mutex
+	used map[*Interaction]bool
+}
+
+// Name implements internal.LLM.
+func (r *Replay) Name() string {
+	if len(r.cassette.Provider) == 0 {
+		return "Replay"
+	}
+	return r.cassette.Provider
+}
+
+// NewSession implements internal.LLM.
+func (*Replay) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+	return nil
+}
+
+// Talk implements internal.LLM.
+func (r *Replay) Talk(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
+	return r.TalkStream(ctx, chatID, opts, history, io.Discard, messages...)
+}
+
+// TalkStream implements internal.StreamLLM.
+func (r *Replay) TalkStream(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, writer io.Writer, messages ...*internal.Message) (*internal.Message, error) {
+	prompt := lastContent(messages)
+	interaction := r.find(prompt)
+	if interaction == nil {
+		return nil, fmt.Errorf("replay: no recorded answer for %q", prompt)
+	}
+
+	result := &internal.Message{
+		ChatID: chatID,
+		Role:   r.Name(),
+		Meta:   interaction.Meta,
+	}
+	chunks := interaction.Chunks
+	if len(chunks) == 0 && len(interaction.Answer) != 0 {
+		chunks = []string{interaction.Answer}
+	}
+	for _, chunk := range chunks {
+		if interaction.DelayMS > 0 {
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case <-time.After(time.Duration(interaction.DelayMS) * time.Millisecond):
+			}
+		}
+		result.Content += chunk
+		if _, err := io.WriteString(writer, chunk); err != nil {
+			return result, err
+		}
+	}
+
+	if len(interaction.Error) != 0 {
+		err := fmt.Errorf("replay: %s", interaction.Error)
+		if interaction.Status != 0 {
+			err = internal.Transient(fmt.Errorf("replay: %s (%d %s)", interaction.Error, interaction.Status, http.StatusText(interaction.Status)), interaction.Status, "")
+		}
+		if len(result.Content) == 0 {
+			return nil, err
+		}
+		return result, err
+	}
+	return result, nil
+}
+
+// find returns the interaction to replay for prompt, nil if there is none.
+func (r *Replay) find(prompt string) *Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var last *Interaction
+	for _, interaction := range r.cassette.Interactions {
+		if !interaction.matches(prompt) {
+			continue
+		}
+		if !r.used[interaction] {
+			r.used[interaction] = true
+			return interaction
+		}
+		last = interaction
+	}
+	return last
+}
+
+// NewRecorder creates a provider which passes the calls to llm and records them
+// into the cassette at path. The cassette is extended if it exists.
+func NewRecorder(llm internal.LLM, path string) (*Recorder, error) {
+	cassette, err := LoadCassette(path)
+	if errors.Is(err, os.ErrNotExist) {
+		cassette, err = &Cassette{Provider: llm.Name()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{llm: llm, path: path, cassette: cassette}, nil
+}
+
+// Recorder records the calls of a LLM into a cassette, the cassette is saved
+// after every call. The prompts are recorded to be matched exactly, calls
+// cancelled by the caller are not recorded. The optional interfaces of the
+// recorded LLM are passed through unrecorded, they fail with
+// errors.ErrUnsupported if it lacks them.
+type Recorder struct {
+	llm  internal.LLM
+	path string
+
+	mu       sync.Mutex
+	cassette *Cassette
+}
+
+// Name implements internal.LLM.
+func (r *Recorder) Name() string {
+	return r.llm.Name()
+}
+
+// NewSession implements internal.LLM.
+func (r *Recorder) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+	return r.llm.NewSession(ctx, chatID, history...)
+}
+
+// DropSession implements internal.SessionDropper.
+func (r *Recorder) DropSession(chatID string) {
+	if dropper, ok := r.llm.(internal.SessionDropper); ok {
+		dropper.DropSession(chatID)
+	}
+}
+
+// Models implements internal.ModelLister.
+func (r *Recorder) Models(ctx context.Context) ([]string, error) {
+	lister, ok := r.llm.(internal.ModelLister)
+	if !ok {
+		return nil, fmt.Errorf("list models of %s: %w", r.Name(), errors.ErrUnsupported)
+	}
+	return lister.Models(ctx)
+}
+
+// CountTokens implements internal.TokenCounter.
+func (r *Recorder) CountTokens(ctx context.Context, model string, messages ...*internal.Message) (int, error) {
+	counter, ok := r.llm.(internal.TokenCounter)
+	if !ok {
+		return 0, fmt.Errorf("count tokens of %s: %w", r.Name(), errors.ErrUnsupported)
+	}
+	return counter.CountTokens(ctx, model, messages...)
+}
+
+// Talk implements internal.LLM.
+func (r *Recorder) Talk(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
+	result, err := r.llm.Talk(ctx, chatID, opts, history, messages...)
+	return result, r.record(messages, result, nil, err)
+}
+
+// TalkStream implements internal.StreamLLM.
+//
+// The chunks are recorded as they are written, so a replay streams alike. If
+// the recorded LLM can't stream, the answer is written at once.
+func (r *Recorder) TalkStream(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, writer io.Writer, messages ...*internal.Message) (*internal.Message, error) {
+	streamer, ok := r.llm.(internal.StreamLLM)
+	if !ok {
+		result, err := r.Talk(ctx, chatID, opts, history, messages...)
+		if err == nil {
+			_, err = io.WriteString(writer, result.Content)
+		}
+		return result, err
+	}
+	chunks := &chunkWriter{writer: writer}
+	result, err := streamer.TalkStream(ctx, chatID, opts, history, chunks, messages...)
+	return result, r.record(messages, result, chunks.chunks, err)
+}
+
+// record adds a call to the cassette and saves it, err is returned unless the
+// cassette can't be saved. A cancelled call is not recorded, it would replay
+// as a failure nobody asked for.
+func (r *Recorder) record(messages []*internal.Message, result *internal.Message, chunks []string, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	interaction := &Interaction{Prompt: lastContent(messages), Chunks: chunks}
+	if result != nil {
+		interaction.Answer = result.Content
+		interaction.Meta = result.Meta
+	}
+	if err != nil {
+		interaction.Error = err.Error()
+		var transient *internal.TransientError
+		if errors.As(err, &transient) {
+			interaction.Status = transient.Status
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+	if sErr := r.cassette.Save(r.path); sErr != nil {
+		return errors.Join(err, sErr)
+	}
+	return err
+}
+
+// chunkWriter keeps the chunks written through it.
+type chunkWriter struct {
+	writer io.Writer
+	chunks []string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, string(p))
+	return w.writer.Write(p)
+}
+
+// lastContent returns the content of the last message, the prompt of a call.
+func lastContent(messages []*internal.Message) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	return messages[len(messages)-1].Content
+}
@@ -0,0 +1,128 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ningzio/geminal/internal"
+)
+
+// fakeLLM answers with its answer or fails with its err, it offers all the
+// optional interfaces of a LLM.
+type fakeLLM struct {
+	answer  string
+	err     error
+	dropped []string
+}
+
+func (*fakeLLM) Name() string { return "fake" }
+
+func (*fakeLLM) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+	return nil
+}
+
+func (ai *fakeLLM) Talk(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
+	return ai.TalkStream(ctx, chatID, opts, history, io.Discard, messages...)
+}
+
+func (ai *fakeLLM) TalkStream(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, writer io.Writer, messages ...*internal.Message) (*internal.Message, error) {
+	if ai.err != nil {
+		return nil, ai.err
+	}
+	for _, chunk := range strings.SplitAfter(ai.answer, " ") {
+		io.WriteString(writer, chunk)
+	}
+	return &internal.Message{ChatID: chatID, Role: ai.Name(), Content: ai.answer}, nil
+}
+
+func (*fakeLLM) Models(ctx context.Context) ([]string, error) {
+	return []string{"fake-1"}, nil
+}
+
+func (*fakeLLM) CountTokens(ctx context.Context, model string, messages ...*internal.Message) (int, error) {
+	return 42, nil
+}
+
+func (ai *fakeLLM) DropSession(chatID string) {
+	ai.dropped = append(ai.dropped, chatID)
+}
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fake.json")
+	fake := &fakeLLM{answer: "recorded answer"}
+	recorder, err := NewRecorder(fake, path)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	ctx := context.Background()
+	prompt := func(content string) *internal.Message {
+		return &internal.Message{Role: internal.RoleUser, Content: content}
+	}
+
+	var streamed strings.Builder
+	if _, err := recorder.TalkStream(ctx, "chat", internal.Options{}, nil, &streamed, prompt("stream")); err != nil {
+		t.Fatalf("TalkStream: %v", err)
+	}
+	fake.err = internal.Transient(errors.New("slow down"), http.StatusTooManyRequests, "")
+	if _, err := recorder.Talk(ctx, "chat", internal.Options{}, nil, prompt("limited")); err == nil {
+		t.Fatal("Talk succeeded, want the error of the LLM")
+	}
+	fake.err = internal.Transient(errors.New("overloaded"), http.StatusBadGateway, "")
+	if _, err := recorder.Talk(ctx, "chat", internal.Options{}, nil, prompt("overloaded")); err == nil {
+		t.Fatal("Talk succeeded, want the error of the LLM")
+	}
+	fake.err = fmt.Errorf("talk: %w", context.Canceled)
+	if _, err := recorder.Talk(ctx, "chat", internal.Options{}, nil, prompt("cancelled")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		t.Fatalf("LoadCassette: %v", err)
+	}
+	if len(cassette.Interactions) != 3 {
+		data, _ := os.ReadFile(path)
+		t.Fatalf("recorded %d interactions, want 3 without the cancelled one:\n%s", len(cassette.Interactions), data)
+	}
+	stream := cassette.Interactions[0]
+	if stream.Prompt != "stream" || stream.Answer != "recorded answer" || strings.Join(stream.Chunks, "|") != "recorded |answer" {
+		t.Errorf("stream recorded as %+v", stream)
+	}
+	for i, want := range []struct {
+		err    string
+		status int
+	}{
+		{"slow down", http.StatusTooManyRequests},
+		{"overloaded", http.StatusBadGateway},
+	} {
+		if got := cassette.Interactions[i+1]; got.Error != want.err || got.Status != want.status {
+			t.Errorf("failure recorded as %q with status %d, want %q with %d", got.Error, got.Status, want.err, want.status)
+		}
+	}
+
+	if models, err := recorder.Models(ctx); err != nil || strings.Join(models, ",") != "fake-1" {
+		t.Errorf("Models = %v, %v", models, err)
+	}
+	if tokens, err := recorder.CountTokens(ctx, "fake-1", prompt("count")); err != nil || tokens != 42 {
+		t.Errorf("CountTokens = %d, %v", tokens, err)
+	}
+	recorder.DropSession("chat")
+	if strings.Join(fake.dropped, ",") != "chat" {
+		t.Errorf("dropped sessions %v, want chat", fake.dropped)
+	}
+
+	replay, err := NewRecorder(NewReplay(cassette), filepath.Join(t.TempDir(), "replay.json"))
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	if _, err := replay.Models(ctx); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Models of a replay = %v, want errors.ErrUnsupported", err)
+	}
+}
@@ -2,100 +2,536 @@ package llm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
 	"github.com/ningzio/geminal/internal"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
-var _ internal.LLM = (*GeminiAI)(nil)
+var (
+	_ internal.StreamLLM      = (*GeminiAI)(nil)
+	_ internal.ModelLister    = (*GeminiAI)(nil)
+	_ internal.TokenCounter   = (*GeminiAI)(nil)
+	_ internal.SessionDropper = (*GeminiAI)(nil)
+)
+
+// GeminiDefaultModel is the model used when a call doesn't ask for another one.
+const GeminiDefaultModel = "gemini-pro"
+
+// geminiVisionModel answers prompts with images when the model of the
+// conversation can't see them, it only supports single turns.
+const geminiVisionModel = "gemini-pro-vision"
 
 func NewGeminiAI(apiKey string) (*GeminiAI, error) {
 	client, err := genai.NewClient(context.Background(), option.WithAPIKey(apiKey))
 	if err != nil {
 		return nil, fmt.Errorf("new gemini ai: %w", err)
 	}
-	model := client.GenerativeModel("gemini-pro")
 	return &GeminiAI{
 		client:   client,
-		model:    model,
-		sessions: make(map[string]*genai.ChatSession),
+		sessions: newSessionCache[*geminiSession](geminiMaxSessions, geminiSessionIdle),
 	}, nil
 }
 
+// bounds of the session cache, a dropped session is recreated from the history
+// of the next call
+const (
+	geminiMaxSessions = 32
+	geminiSessionIdle = 30 * time.Minute
+)
+
 // GeminiAI is a client for the Gemini AI API.
 type GeminiAI struct {
 	client *genai.Client
-	model  *genai.GenerativeModel
 
-	sessions map[string]*genai.ChatSession
+	sessions *sessionCache[*geminiSession]
+}
+
+// geminiSession is a chat session together with the model it talks to.
+type geminiSession struct {
+	// mu serializes the calls of the session
+	mu sync.Mutex
+	*genai.ChatSession
+	model *genai.GenerativeModel
+	name  string
+	// system prompt the session was primed with
+	system string
+	// size and first are the length and the first content of the history the
+	// session was created with plus the messages exchanged since then, the
+	// session is recreated when the history of a call doesn't match them.
+	size  int
+	first string
+}
+
+// matches tells whether session continues history.
+func (session *geminiSession) matches(history []*internal.Message) bool {
+	return session.size == len(history) && session.first == firstContent(history)
 }
 
+// exchanged adds an answered exchange of messages to the size of session.
+func (session *geminiSession) exchanged(messages []*internal.Message) {
+	if session.size == 0 {
+		session.first = firstContent(messages)
+	}
+	session.size += len(messages) + 1
+}
+
+func firstContent(messages []*internal.Message) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	return messages[0].Content
+}
+
+// geminiPrimingAnswer is the answer of the model to the system prompt. Gemini has
+// no system instructions, so the prompt is sent as the first turn of the history.
+const geminiPrimingAnswer = "OK, I will follow these instructions in this conversation."
+
 // Name implements internal.LLM.
 func (*GeminiAI) Name() string {
 	return "Gemini Pro"
 }
 
 // NewSession implements internal.LLM.
-func (*GeminiAI) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+//
+// The session of chatID is replaced by a session of the default model which
+// starts from history, the next call recreates it if it asks for another model
+// or system prompt.
+func (ai *GeminiAI) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+	ai.sessions.put(chatID, ai.newSession(internal.Options{}, history))
 	return nil
 }
 
-// Talk implements internal.LLM.
-func (ai *GeminiAI) Talk(ctx context.Context, chatID string, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
-	session, ok := ai.sessions[chatID]
-	if !ok {
-		session = ai.model.StartChat()
-		for _, msg := range history {
-			var role string
-			if msg.Role == ai.Name() {
-				role = "model"
-			} else {
-				role = "user"
-			}
-			session.History = append(session.History, &genai.Content{
-				Parts: []genai.Part{genai.Text(string(msg.Content))},
-				Role:  role,
-			})
+// DropSession implements internal.SessionDropper.
+func (ai *GeminiAI) DropSession(chatID string) {
+	ai.sessions.delete(chatID)
+}
+
+// Models implements internal.ModelLister.
+func (ai *GeminiAI) Models(ctx context.Context) ([]string, error) {
+	var models []string
+	iter := ai.client.ListModels(ctx)
+	for {
+		model, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			return models, nil
+		}
+		if err != nil {
+			return nil, geminiError(fmt.Errorf("list gemini models: %w", err))
+		}
+		if slices.Contains(model.SupportedGenerationMethods, "generateContent") {
+			models = append(models, strings.TrimPrefix(model.Name, "models/"))
 		}
-		ai.sessions[chatID] = session
 	}
+}
 
-	var prompts []genai.Part
-	for _, msg := range messages {
-		prompts = append(prompts, genai.Text(string(msg.Content)))
+// CountTokens implements internal.TokenCounter.
+func (ai *GeminiAI) CountTokens(ctx context.Context, model string, messages ...*internal.Message) (int, error) {
+	if len(model) == 0 {
+		model = GeminiDefaultModel
 	}
+	parts := prompts(messages, isVision(model))
+	if len(parts) == 0 {
+		return 0, nil
+	}
+	resp, err := ai.client.GenerativeModel(model).CountTokens(ctx, parts...)
+	if err != nil {
+		return 0, geminiError(fmt.Errorf("count gemini tokens: %w", err))
+	}
+	return int(resp.TotalTokens), nil
+}
+
+// Talk implements internal.LLM.
+//
+// A blocked prompt or answer is not an error, it is reported by the Meta of
+// the returned message.
+func (ai *GeminiAI) Talk(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
+	session := ai.session(chatID, opts, history)
+	defer session.mu.Unlock()
+	if hasImages(messages) && !isVision(session.name) {
+		return ai.talkVision(ctx, chatID, session, io.Discard, messages)
+	}
+	turns := len(session.History)
 
 	result := &internal.Message{
 		ChatID: chatID,
 		Role:   ai.Name(),
 	}
 
-	resp, err := session.SendMessage(ctx, prompts...)
+	resp, err := session.SendMessage(ctx, prompts(messages, isVision(session.name))...)
 	if err != nil {
-		return nil, err
+		// drop the unanswered prompt, so the next call starts from a clean history
+		session.History = session.History[:turns]
+		if blocked(err, result) {
+			return result, nil
+		}
+		return nil, geminiError(err)
+	}
+
+	session.exchanged(messages)
+	if len(resp.Candidates) != 0 {
+		result.Content = candidateText(resp.Candidates[0])
+		setCandidateMeta(result, resp.Candidates[0])
+	}
+	// the session continues with the first candidate, the others are alternatives
+	for _, candidate := range resp.Candidates[min(1, len(resp.Candidates)):] {
+		alternative := &internal.Message{Role: ai.Name()}
+		setCandidateMeta(alternative, candidate)
+		result.Alternatives = append(result.Alternatives, &internal.Alternative{
+			Role:    ai.Name(),
+			Content: candidateText(candidate),
+			Meta:    alternative.Meta,
+		})
+	}
+	return result, nil
+}
+
+// TalkStream implements internal.StreamLLM.
+//
+// Every text chunk is written to writer as soon as Gemini produces it, the
+// returned message holds the whole answer once the stream is exhausted.
+func (ai *GeminiAI) TalkStream(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, writer io.Writer, messages ...*internal.Message) (*internal.Message, error) {
+	session := ai.session(chatID, opts, history)
+	defer session.mu.Unlock()
+	if hasImages(messages) && !isVision(session.name) {
+		return ai.talkVision(ctx, chatID, session, writer, messages)
+	}
+	turns := len(session.History)
+
+	result := &internal.Message{
+		ChatID: chatID,
+		Role:   ai.Name(),
+	}
+
+	iter := session.SendMessageStream(ctx, prompts(messages, isVision(session.name))...)
+	failed := false
+	err := readStream(iter, result, writer, func() {
+		// drop the unanswered prompt, so the next call starts from a clean history
+		session.History = session.History[:turns]
+		failed = true
+	})
+	if !failed {
+		session.exchanged(messages)
+	}
+	return result, err
+}
+
+// talkVision sends messages with their images to the vision model in a single
+// turn. The exchange is added to session with placeholders instead of images,
+// so the conversation can go on with the model of session.
+func (ai *GeminiAI) talkVision(ctx context.Context, chatID string, session *geminiSession, writer io.Writer, messages []*internal.Message) (*internal.Message, error) {
+	model := ai.client.GenerativeModel(geminiVisionModel)
+	model.GenerationConfig = session.model.GenerationConfig
+	model.SafetySettings = session.model.SafetySettings
+
+	result := &internal.Message{
+		ChatID: chatID,
+		Role:   ai.Name(),
+	}
+
+	// the vision model takes a single turn, the system prompt goes in front of it
+	parts := prompts(messages, true)
+	if len(session.system) != 0 {
+		parts = append([]genai.Part{genai.Text(session.system)}, parts...)
+	}
+	iter := model.GenerateContentStream(ctx, parts...)
+	if err := readStream(iter, result, writer, func() {}); err != nil {
+		return result, err
+	}
+	if len(result.Content) != 0 {
+		session.exchanged(messages)
+		session.History = append(session.History,
+			&genai.Content{Parts: prompts(messages, false), Role: "user"},
+			&genai.Content{Parts: []genai.Part{genai.Text(result.Content)}, Role: "model"},
+		)
+	}
+	return result, nil
+}
+
+// readStream reads the answer of iter into result and writes its text to
+// writer. onError is called before an error is returned, a blocked prompt or
+// answer is reported by the meta of result instead of an error.
+func readStream(iter *genai.GenerateContentResponseIterator, result *internal.Message, writer io.Writer, onError func()) error {
+	for {
+		resp, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			onError()
+			if blocked(err, result) {
+				return nil
+			}
+			return geminiError(err)
+		}
+		if len(resp.Candidates) == 0 {
+			continue
+		}
+		setCandidateMeta(result, resp.Candidates[0])
+		text := candidateText(resp.Candidates[0])
+		if len(text) == 0 {
+			continue
+		}
+		result.Content += text
+		if _, err := io.WriteString(writer, text); err != nil {
+			onError()
+			return err
+		}
+	}
+}
+
+// geminiError marks err as transient if Gemini is rate limited or overloaded.
+func geminiError(err error) error {
+	apiErr, ok := apierror.FromError(err)
+	if !ok {
+		return err
+	}
+	err = internal.Transient(err, apiErr.HTTPCode(), "")
+	var transient *internal.TransientError
+	if errors.As(err, &transient) && apiErr.Details().RetryInfo != nil {
+		transient.RetryAfter = apiErr.Details().RetryInfo.GetRetryDelay().AsDuration()
+	}
+	return err
+}
+
+// candidateText returns the text parts of candidate.
+func candidateText(candidate *genai.Candidate) string {
+	if candidate.Content == nil {
+		return ""
+	}
+	var text string
+	for _, part := range candidate.Content.Parts {
+		if t, ok := part.(genai.Text); ok {
+			text += string(t)
+		}
+	}
+	return text
+}
+
+// setCandidateMeta adds the finish reason, safety ratings and citations of
+// candidate to the meta of result. Candidates of a stream are merged.
+func setCandidateMeta(result *internal.Message, candidate *genai.Candidate) {
+	if candidate.FinishReason == genai.FinishReasonUnspecified && len(candidate.SafetyRatings) == 0 && candidate.CitationMetadata == nil {
+		return
+	}
+	if result.Meta == nil {
+		result.Meta = &internal.ResponseMeta{}
+	}
+	if reason := finishReason(candidate.FinishReason); len(reason) != 0 {
+		result.Meta.FinishReason = reason
+	}
+	if len(candidate.SafetyRatings) != 0 {
+		result.Meta.SafetyRatings = safetyRatings(candidate.SafetyRatings)
+	}
+	if candidate.CitationMetadata != nil {
+		for _, source := range candidate.CitationMetadata.CitationSources {
+			citation := internal.Citation{License: source.License}
+			if source.URI != nil {
+				citation.URI = *source.URI
+			}
+			if source.StartIndex != nil {
+				citation.StartIndex = int(*source.StartIndex)
+			}
+			if source.EndIndex != nil {
+				citation.EndIndex = int(*source.EndIndex)
+			}
+			result.Meta.Citations = append(result.Meta.Citations, citation)
+		}
+	}
+}
+
+// blocked reports whether err tells that the prompt or the answer was blocked,
+// the details are added to the meta of result.
+func blocked(err error, result *internal.Message) bool {
+	var blockedErr *genai.BlockedError
+	if !errors.As(err, &blockedErr) {
+		return false
+	}
+	if result.Meta == nil {
+		result.Meta = &internal.ResponseMeta{}
+	}
+	result.Meta.Blocked = true
+	if feedback := blockedErr.PromptFeedback; feedback != nil {
+		result.Meta.BlockReason = "prompt: " + strings.ToLower(strings.TrimPrefix(feedback.BlockReason.String(), "BlockReason"))
+		result.Meta.SafetyRatings = safetyRatings(feedback.SafetyRatings)
+	}
+	if candidate := blockedErr.Candidate; candidate != nil {
+		result.Meta.BlockReason = "answer: " + strings.ToLower(strings.TrimPrefix(candidate.FinishReason.String(), "FinishReason"))
+		setCandidateMeta(result, candidate)
+	}
+	return true
+}
+
+func finishReason(reason genai.FinishReason) string {
+	switch reason {
+	case genai.FinishReasonStop:
+		return internal.FinishReasonStop
+	case genai.FinishReasonMaxTokens:
+		return internal.FinishReasonMaxTokens
+	case genai.FinishReasonSafety:
+		return internal.FinishReasonSafety
+	case genai.FinishReasonRecitation:
+		return internal.FinishReasonRecitation
+	case genai.FinishReasonOther:
+		return internal.FinishReasonOther
+	}
+	return ""
+}
+
+func safetyRatings(ratings []*genai.SafetyRating) []internal.SafetyRating {
+	result := make([]internal.SafetyRating, 0, len(ratings))
+	for _, r := range ratings {
+		result = append(result, internal.SafetyRating{
+			Category:    strings.TrimPrefix(r.Category.String(), "HarmCategory"),
+			Probability: strings.TrimPrefix(r.Probability.String(), "HarmProbability"),
+			Blocked:     r.Blocked,
+		})
 	}
+	return result
+}
 
-	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != 0 {
-		switch resp.PromptFeedback.BlockReason {
-		case genai.BlockReasonSafety:
-			for _, rating := range resp.PromptFeedback.SafetyRatings {
-				result.ErrMsg += fmt.Sprintf("%s: %s, block: %v", rating.Category, rating.Probability, rating.Blocked)
+// safetySettings converts the safety settings of a conversation, unknown
+// categories and thresholds are ignored.
+func safetySettings(settings []internal.SafetySetting) []*genai.SafetySetting {
+	categories := map[string]genai.HarmCategory{
+		internal.HarmCategoryHarassment:       genai.HarmCategoryHarassment,
+		internal.HarmCategoryHateSpeech:       genai.HarmCategoryHateSpeech,
+		internal.HarmCategorySexuallyExplicit: genai.HarmCategorySexuallyExplicit,
+		internal.HarmCategoryDangerousContent: genai.HarmCategoryDangerousContent,
+	}
+	thresholds := map[string]genai.HarmBlockThreshold{
+		internal.BlockNone:           genai.HarmBlockNone,
+		internal.BlockOnlyHigh:       genai.HarmBlockOnlyHigh,
+		internal.BlockMediumAndAbove: genai.HarmBlockMediumAndAbove,
+		internal.BlockLowAndAbove:    genai.HarmBlockLowAndAbove,
+	}
+
+	var result []*genai.SafetySetting
+	for _, s := range settings {
+		category, ok := categories[s.Category]
+		if !ok {
+			continue
+		}
+		threshold, ok := thresholds[s.Threshold]
+		if !ok {
+			continue
+		}
+		result = append(result, &genai.SafetySetting{Category: category, Threshold: threshold})
+	}
+	return result
+}
+
+// session returns the chat session of chatID locked, it will be created from
+// history if there is no such session yet, the session talks to another model
+// or with another system prompt, or history was shortened to fit into the
+// context window. The generation parameters of opts are applied to the session.
+// A session of an empty chatID is a one-off, it is not kept.
+func (ai *GeminiAI) session(chatID string, opts internal.Options, history []*internal.Message) *geminiSession {
+	session, ok := ai.sessions.get(chatID)
+	if ok {
+		session.mu.Lock()
+		if session.name != modelName(opts) || session.system != opts.SystemPrompt || !session.matches(history) {
+			session.mu.Unlock()
+			ok = false
+		}
+	}
+	if !ok {
+		session = ai.newSession(opts, history)
+		session.mu.Lock()
+		if len(chatID) != 0 {
+			ai.sessions.put(chatID, session)
+		}
+	}
+	session.model.GenerationConfig = genai.GenerationConfig{
+		Temperature:     opts.Generation.Temperature,
+		TopP:            opts.Generation.TopP,
+		TopK:            opts.Generation.TopK,
+		MaxOutputTokens: opts.Generation.MaxOutputTokens,
+		StopSequences:   opts.Generation.StopSequences,
+		CandidateCount:  opts.Generation.CandidateCount,
+	}
+	session.model.SafetySettings = safetySettings(opts.Safety)
+	return session
+}
+
+// newSession creates a session of the model and the system prompt of opts
+// which starts from history.
+func (ai *GeminiAI) newSession(opts internal.Options, history []*internal.Message) *geminiSession {
+	name := modelName(opts)
+	model := ai.client.GenerativeModel(name)
+	session := &geminiSession{
+		ChatSession: model.StartChat(),
+		model:       model,
+		name:        name,
+		system:      opts.SystemPrompt,
+		size:        len(history),
+		first:       firstContent(history),
+	}
+	if len(opts.SystemPrompt) != 0 {
+		session.History = append(session.History,
+			&genai.Content{Parts: []genai.Part{genai.Text(opts.SystemPrompt)}, Role: "user"},
+			&genai.Content{Parts: []genai.Part{genai.Text(geminiPrimingAnswer)}, Role: "model"},
+		)
+	}
+	for _, msg := range history {
+		role := "model"
+		if msg.Role == internal.RoleUser {
+			role = "user"
+		}
+		if role == "model" && len(msg.Content) == 0 {
+			// gemini rejects empty turns, drop the prompt of an empty
+			// answer as well to keep the turns alternating
+			if n := len(session.History); n != 0 && session.History[n-1].Role == "user" {
+				session.History = session.History[:n-1]
 			}
-		case genai.BlockReasonOther:
-			result.ErrMsg += fmt.Sprintf("block: %v", resp.PromptFeedback.BlockReason)
+			continue
 		}
-		return result, nil
+		session.History = append(session.History, &genai.Content{
+			Parts: prompts([]*internal.Message{msg}, isVision(name)),
+			Role:  role,
+		})
+	}
+	return session
+}
+
+// modelName returns the model of opts, the default model if it is empty.
+func modelName(opts internal.Options) string {
+	if len(opts.Model) == 0 {
+		return GeminiDefaultModel
 	}
+	return opts.Model
+}
 
-	for _, i := range resp.Candidates[0].Content.Parts {
-		switch i := i.(type) {
-		case genai.Text:
-			result.Content += string(i)
-		case genai.Blob:
-		default:
+// prompts converts messages to the parts of a gemini request. Images are sent
+// as blobs if vision is true, as placeholders otherwise.
+func prompts(messages []*internal.Message, vision bool) []genai.Part {
+	var parts []genai.Part
+	for _, msg := range messages {
+		if text := messageText(msg, !vision); len(text) != 0 {
+			parts = append(parts, genai.Text(text))
+		}
+		if !vision {
+			continue
+		}
+		for _, attachment := range msg.Attachments {
+			if attachment.IsImage() {
+				parts = append(parts, genai.Blob{MIMEType: attachment.MIMEType, Data: attachment.Data})
+			}
 		}
 	}
-	return result, nil
+	return parts
+}
+
+// isVision tells whether the model called name can see images.
+func isVision(name string) bool {
+	return strings.Contains(name, "vision")
 }
@@ -0,0 +1,245 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ningzio/geminal/internal"
+)
+
+var (
+	_ internal.StreamLLM   = (*Ollama)(nil)
+	_ internal.ModelLister = (*Ollama)(nil)
+)
+
+// ErrModelNotPulled is returned in a internal.SetupError when the requested
+// model is not installed on the Ollama server.
+var ErrModelNotPulled = errors.New("model is not pulled")
+
+// NewOllama creates a client of the Ollama server at host, e.g. "http://localhost:11434".
+// model is used when a call doesn't ask for another one.
+func NewOllama(host, model string) *Ollama {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return &Ollama{
+		host:   strings.TrimSuffix(host, "/"),
+		model:  model,
+		client: http.DefaultClient,
+	}
+}
+
+// Ollama is a client for the chat API of a local Ollama server.
+type Ollama struct {
+	host   string
+	model  string
+	client *http.Client
+}
+
+// Name implements internal.LLM.
+func (*Ollama) Name() string {
+	return "Ollama"
+}
+
+// NewSession implements internal.LLM.
+//
+// The chat API is stateless, the whole history is sent on every call.
+func (*Ollama) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+	return nil
+}
+
+// Talk implements internal.LLM.
+func (ai *Ollama) Talk(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
+	return ai.TalkStream(ctx, chatID, opts, history, io.Discard, messages...)
+}
+
+// TalkStream implements internal.StreamLLM.
+//
+// The answer is read from the newline delimited JSON objects of the response.
+func (ai *Ollama) TalkStream(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, writer io.Writer, messages ...*internal.Message) (*internal.Message, error) {
+	req := &ollamaRequest{
+		Model:  ai.model,
+		Stream: true,
+		Options: ollamaOptions{
+			Temperature: opts.Generation.Temperature,
+			TopP:        opts.Generation.TopP,
+			TopK:        opts.Generation.TopK,
+			NumPredict:  opts.Generation.MaxOutputTokens,
+			Stop:        opts.Generation.StopSequences,
+		},
+	}
+	if len(opts.Model) != 0 {
+		req.Model = opts.Model
+	}
+	if len(opts.SystemPrompt) != 0 {
+		req.Messages = append(req.Messages, ollamaMessage{
+			Role:    "system",
+			Content: opts.SystemPrompt,
+		})
+	}
+	for _, msg := range append(history[:len(history):len(history)], messages...) {
+		message := ollamaMessage{
+			Role:    chatRole(msg.Role),
+			Content: messageText(msg, false),
+		}
+		for _, attachment := range msg.Attachments {
+			if attachment.IsImage() {
+				message.Images = append(message.Images, base64.StdEncoding.EncodeToString(attachment.Data))
+			}
+		}
+		req.Messages = append(req.Messages, message)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("ollama: encode request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, ai.host+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("ollama: new request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := ai.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("ollama: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ai.responseError(ctx, req.Model, resp)
+	}
+
+	result := &internal.Message{
+		ChatID: chatID,
+		Role:   ai.Name(),
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var chunk ollamaResponse
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return result, fmt.Errorf("ollama: decode response: %w", err)
+		}
+		if len(chunk.Error) != 0 {
+			return result, fmt.Errorf("ollama: %s", chunk.Error)
+		}
+		if len(chunk.Message.Content) != 0 {
+			result.Content += chunk.Message.Content
+			if _, err := io.WriteString(writer, chunk.Message.Content); err != nil {
+				return result, err
+			}
+		}
+		if chunk.Done {
+			// done_reason is reported by newer servers only, it uses the
+			// values of the chat completions API
+			setFinishReason(result, chunk.DoneReason)
+			result.PromptTokens = chunk.PromptEvalCount
+			result.ResponseTokens = chunk.EvalCount
+			return result, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("ollama: read response: %w", err)
+	}
+	return result, nil
+}
+
+// Models returns the names of the models installed on the server.
+func (ai *Ollama) Models(ctx context.Context) ([]string, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, ai.host+"/api/tags", nil)
+	if err != nil {
+		return nil, fmt.Errorf("ollama: new request: %w", err)
+	}
+	resp, err := ai.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("ollama: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("ollama: list models: %s", resp.Status)
+		return nil, internal.Transient(err, resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("ollama: decode models: %w", err)
+	}
+	models := make([]string, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		models = append(models, m.Name)
+	}
+	return models, nil
+}
+
+// responseError converts a failed chat response to an error. A missing model is
+// reported as ErrModelNotPulled together with the models which are installed.
+func (ai *Ollama) responseError(ctx context.Context, model string, resp *http.Response) error {
+	var body ollamaResponse
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(data, &body); err != nil || len(body.Error) == 0 {
+		body.Error = strings.TrimSpace(string(data))
+	}
+
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(body.Error, "not found") {
+		err := fmt.Errorf("ollama: %s", resp.Status)
+		if len(body.Error) != 0 {
+			err = fmt.Errorf("ollama: %s (%s)", body.Error, resp.Status)
+		}
+		return internal.Transient(err, resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	err := fmt.Errorf("ollama: %w: %s, run \"ollama pull %s\" first", ErrModelNotPulled, model, model)
+	if models, lErr := ai.Models(ctx); lErr == nil && len(models) != 0 {
+		err = fmt.Errorf("%w, installed models: %s", err, strings.Join(models, ", "))
+	}
+	// the user pulls the model, it is shown in the warning besides the chat
+	return &internal.SetupError{Err: err}
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Options  ollamaOptions   `json:"options"`
+}
+
+type ollamaOptions struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	TopK        *int32   `json:"top_k,omitempty"`
+	NumPredict  *int32   `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images are base64 encoded, they need a multimodal model like llava
+	Images []string `json:"images,omitempty"`
+}
+
+type ollamaResponse struct {
+	Message    ollamaMessage `json:"message"`
+	Done       bool          `json:"done"`
+	DoneReason string        `json:"done_reason"`
+	Error      string        `json:"error"`
+	// token counts of the request and the answer, sent with the last chunk
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
@@ -0,0 +1,356 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ningzio/geminal/internal"
+)
+
+var (
+	_ internal.StreamLLM   = (*OpenAI)(nil)
+	_ internal.ModelLister = (*OpenAI)(nil)
+)
+
+// NewOpenAI creates a client of an OpenAI compatible chat completions API.
+//
+// baseURL is the url in front of "/chat/completions", e.g. "https://api.openai.com/v1"
+// or "http://localhost:8000/v1" for a local vLLM server. apiKey may be empty for
+// servers which don't need authentication. model is used when a call doesn't
+// ask for another one.
+func NewOpenAI(baseURL, apiKey, model string) *OpenAI {
+	return &OpenAI{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   model,
+		client:  http.DefaultClient,
+	}
+}
+
+// OpenAI is a client for any OpenAI compatible /v1/chat/completions endpoint.
+type OpenAI struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+// Name implements internal.LLM.
+func (*OpenAI) Name() string {
+	return "OpenAI"
+}
+
+// NewSession implements internal.LLM.
+//
+// The chat completions API is stateless, the whole history is sent on every call.
+func (*OpenAI) NewSession(ctx context.Context, chatID string, history ...*internal.Message) error {
+	return nil
+}
+
+// Talk implements internal.LLM.
+func (ai *OpenAI) Talk(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, messages ...*internal.Message) (*internal.Message, error) {
+	resp, err := ai.send(ctx, ai.request(false, opts, history, messages))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var completion openAICompletion
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return nil, fmt.Errorf("openai: decode response: %w", err)
+	}
+
+	result := &internal.Message{
+		ChatID: chatID,
+		Role:   ai.Name(),
+	}
+	if len(completion.Choices) > 0 {
+		result.Content = completion.Choices[0].Message.Content
+		setFinishReason(result, completion.Choices[0].FinishReason)
+	}
+	completion.setUsage(result)
+	return result, nil
+}
+
+// TalkStream implements internal.StreamLLM.
+//
+// The answer is read from the server-sent events of a streaming request.
+func (ai *OpenAI) TalkStream(ctx context.Context, chatID string, opts internal.Options, history []*internal.Message, writer io.Writer, messages ...*internal.Message) (*internal.Message, error) {
+	resp, err := ai.send(ctx, ai.request(true, opts, history, messages))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &internal.Message{
+		ChatID: chatID,
+		Role:   ai.Name(),
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			// empty lines separate events, comments and other fields are not used
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return result, nil
+		}
+
+		var chunk openAICompletion
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return result, fmt.Errorf("openai: decode event: %w", err)
+		}
+		chunk.setUsage(result)
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		setFinishReason(result, chunk.Choices[0].FinishReason)
+		if len(chunk.Choices[0].Delta.Content) == 0 {
+			continue
+		}
+		result.Content += chunk.Choices[0].Delta.Content
+		if _, err := io.WriteString(writer, chunk.Choices[0].Delta.Content); err != nil {
+			return result, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("openai: read stream: %w", err)
+	}
+	// some servers close the stream without sending [DONE]
+	return result, nil
+}
+
+// Models implements internal.ModelLister.
+func (ai *OpenAI) Models(ctx context.Context) ([]string, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, ai.baseURL+"/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("openai: new request: %w", err)
+	}
+	if len(ai.apiKey) != 0 {
+		httpReq.Header.Set("Authorization", "Bearer "+ai.apiKey)
+	}
+	resp, err := ai.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("openai: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, openAIError(resp)
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("openai: decode models: %w", err)
+	}
+	models := make([]string, 0, len(list.Data))
+	for _, m := range list.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
+// request builds the chat completions request of history followed by messages.
+func (ai *OpenAI) request(stream bool, opts internal.Options, history, messages []*internal.Message) *openAIRequest {
+	req := &openAIRequest{
+		Model:  ai.model,
+		Stream: stream,
+	}
+	if len(opts.Model) != 0 {
+		req.Model = opts.Model
+	}
+	// top k is not part of the chat completions API
+	req.Temperature = opts.Generation.Temperature
+	req.TopP = opts.Generation.TopP
+	req.MaxTokens = opts.Generation.MaxOutputTokens
+	req.Stop = opts.Generation.StopSequences
+	if len(opts.SystemPrompt) != 0 {
+		req.Messages = append(req.Messages, openAIMessage{
+			Role:    "system",
+			Content: opts.SystemPrompt,
+		})
+	}
+	for _, msg := range history {
+		req.Messages = append(req.Messages, newOpenAIMessage(msg))
+	}
+	for _, msg := range messages {
+		req.Messages = append(req.Messages, newOpenAIMessage(msg))
+	}
+	return req
+}
+
+// newOpenAIMessage converts msg to a chat completions message. Images are
+// sent as data URLs, which needs a vision capable model.
+func newOpenAIMessage(msg *internal.Message) openAIMessage {
+	if !hasImages([]*internal.Message{msg}) {
+		return openAIMessage{
+			Role:    chatRole(msg.Role),
+			Content: messageText(msg, false),
+		}
+	}
+
+	parts := []openAIPart{{Type: "text", Text: messageText(msg, false)}}
+	for _, attachment := range msg.Attachments {
+		if !attachment.IsImage() {
+			continue
+		}
+		url := "data:" + attachment.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(attachment.Data)
+		parts = append(parts, openAIPart{Type: "image_url", ImageURL: &openAIImageURL{URL: url}})
+	}
+	return openAIMessage{
+		Role:    chatRole(msg.Role),
+		Content: parts,
+	}
+}
+
+// send posts req to the chat completions endpoint, the caller must close
+// the body of the returned response.
+func (ai *OpenAI) send(ctx context.Context, req *openAIRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("openai: encode request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, ai.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("openai: new request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.Stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
+	if len(ai.apiKey) != 0 {
+		httpReq.Header.Set("Authorization", "Bearer "+ai.apiKey)
+	}
+
+	resp, err := ai.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("openai: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, openAIError(resp)
+	}
+	return resp, nil
+}
+
+// openAIError converts a failed response to an error, the message reported by
+// the server is used if there is one. Rate limits and overloads are transient.
+func openAIError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	var err error
+	if jErr := json.Unmarshal(data, &body); jErr == nil && len(body.Error.Message) != 0 {
+		err = fmt.Errorf("openai: %s (%s)", body.Error.Message, resp.Status)
+	} else if msg := strings.TrimSpace(string(data)); len(msg) != 0 {
+		err = fmt.Errorf("openai: %s (%s)", msg, resp.Status)
+	} else {
+		err = fmt.Errorf("openai: %s", resp.Status)
+	}
+	return internal.Transient(err, resp.StatusCode, resp.Header.Get("Retry-After"))
+}
+
+// setFinishReason sets the finish reason of a chat completion on result.
+func setFinishReason(result *internal.Message, reason string) {
+	var finish string
+	switch reason {
+	case "":
+		return
+	case "stop":
+		finish = internal.FinishReasonStop
+	case "length":
+		finish = internal.FinishReasonMaxTokens
+	case "content_filter":
+		finish = internal.FinishReasonSafety
+	default:
+		finish = internal.FinishReasonOther
+	}
+	if result.Meta == nil {
+		result.Meta = &internal.ResponseMeta{}
+	}
+	result.Meta.FinishReason = finish
+}
+
+// chatRole maps the role of a message to the role used by chat APIs.
+func chatRole(role string) string {
+	switch role {
+	case internal.RoleUser:
+		return "user"
+	case internal.RoleSystem:
+		return "system"
+	default:
+		return "assistant"
+	}
+}
+
+type openAIRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Stream      bool            `json:"stream"`
+	Temperature *float32        `json:"temperature,omitempty"`
+	TopP        *float32        `json:"top_p,omitempty"`
+	MaxTokens   *int32          `json:"max_tokens,omitempty"`
+	Stop        []string        `json:"stop,omitempty"`
+}
+
+type openAIMessage struct {
+	Role string `json:"role"`
+	// Content is a string or the []openAIPart of a message with images
+	Content any `json:"content"`
+}
+
+type openAIPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+// openAICompletion is either a complete answer or a chunk of a streaming one.
+type openAICompletion struct {
+	Choices []struct {
+		Message      openAIAnswer `json:"message"`
+		Delta        openAIAnswer `json:"delta"`
+		FinishReason string       `json:"finish_reason"`
+	} `json:"choices"`
+	// Usage is sent with a complete answer, and with the last chunk by some servers
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// setUsage sets the token usage reported with completion on result.
+func (completion *openAICompletion) setUsage(result *internal.Message) {
+	if completion.Usage != nil {
+		result.PromptTokens = completion.Usage.PromptTokens
+		result.ResponseTokens = completion.Usage.CompletionTokens
+	}
+}
+
+type openAIAnswer struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
@@ -0,0 +1,269 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ningzio/geminal/internal"
+)
+
+// openAIServer serves handler as the chat completions endpoint, the decoded
+// body and the headers of the last request are stored in the returned values.
+func openAIServer(t *testing.T, handler http.HandlerFunc) (*OpenAI, *map[string]any, *http.Header) {
+	t.Helper()
+	body := map[string]any{}
+	header := http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("request %s %s, want POST /v1/chat/completions", r.Method, r.URL.Path)
+		}
+		header = r.Header.Clone()
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return NewOpenAI(server.URL+"/v1/", "secret", "default-model"), &body, &header
+}
+
+func TestOpenAIRequest(t *testing.T) {
+	ai, body, header := openAIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"hello"},"finish_reason":"length"}],"usage":{"prompt_tokens":12,"completion_tokens":3}}`)
+	})
+
+	temperature, maxTokens := float32(0.5), int32(64)
+	opts := internal.Options{
+		Model:        "gpt-test",
+		SystemPrompt: "be brief",
+		Generation: internal.GenerationConfig{
+			Temperature:     &temperature,
+			MaxOutputTokens: &maxTokens,
+			StopSequences:   []string{"END"},
+		},
+	}
+	history := []*internal.Message{
+		{Role: internal.RoleUser, Content: "hi"},
+		{Role: "OpenAI", Content: "hi there"},
+	}
+	prompt := &internal.Message{
+		Role:    internal.RoleUser,
+		Content: "what is this?",
+		Attachments: []*internal.Attachment{
+			{Name: "a.png", MIMEType: "image/png", Data: []byte{1, 2, 3}},
+		},
+	}
+
+	result, err := ai.Talk(context.Background(), "chat", opts, history, prompt)
+	if err != nil {
+		t.Fatalf("Talk: %v", err)
+	}
+
+	want := map[string]any{
+		"model":       "gpt-test",
+		"stream":      false,
+		"temperature": 0.5,
+		"max_tokens":  float64(64),
+		"stop":        []any{"END"},
+		"messages": []any{
+			map[string]any{"role": "system", "content": "be brief"},
+			map[string]any{"role": "user", "content": "hi"},
+			map[string]any{"role": "assistant", "content": "hi there"},
+			map[string]any{"role": "user", "content": []any{
+				map[string]any{"type": "text", "text": "what is this?"},
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64,AQID"}},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(*body, want) {
+		got, _ := json.MarshalIndent(*body, "", "  ")
+		t.Errorf("request body:\n%s", got)
+	}
+	if auth := header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("Authorization = %q, want Bearer secret", auth)
+	}
+
+	if result.Content != "hello" || result.Role != "OpenAI" || result.ChatID != "chat" {
+		t.Errorf("result = %+v", result)
+	}
+	if result.PromptTokens != 12 || result.ResponseTokens != 3 {
+		t.Errorf("tokens = %d/%d, want 12/3", result.PromptTokens, result.ResponseTokens)
+	}
+	if result.Meta == nil || result.Meta.FinishReason != internal.FinishReasonMaxTokens {
+		t.Errorf("meta = %+v, want finish reason %s", result.Meta, internal.FinishReasonMaxTokens)
+	}
+}
+
+func TestOpenAIRequestDefaultModel(t *testing.T) {
+	ai, body, header := openAIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"choices":[]}`)
+	})
+	ai.apiKey = ""
+
+	result, err := ai.Talk(context.Background(), "chat", internal.Options{}, nil, &internal.Message{Role: internal.RoleUser, Content: "hi"})
+	if err != nil {
+		t.Fatalf("Talk: %v", err)
+	}
+	if (*body)["model"] != "default-model" {
+		t.Errorf("model = %v, want default-model", (*body)["model"])
+	}
+	for _, key := range []string{"temperature", "top_p", "max_tokens", "stop"} {
+		if _, ok := (*body)[key]; ok {
+			t.Errorf("%s is sent although it is not set", key)
+		}
+	}
+	if auth := header.Get("Authorization"); len(auth) != 0 {
+		t.Errorf("Authorization = %q without an api key", auth)
+	}
+	if len(result.Content) != 0 || result.Meta != nil {
+		t.Errorf("result of no choices = %+v", result)
+	}
+}
+
+func TestOpenAITalkStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		events string
+		want   string
+	}{
+		{
+			name: "done",
+			events: ": keep-alive\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+				"data:{\"choices\":[{\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":2}}\n\n" +
+				"data: [DONE]\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\" after done\"}}]}\n\n",
+			want: "Hello",
+		},
+		{
+			name: "closed without done",
+			events: "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":2}}\n\n",
+			want: "Hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ai, body, header := openAIServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, tt.events)
+			})
+
+			var streamed strings.Builder
+			result, err := ai.TalkStream(context.Background(), "chat", internal.Options{}, nil, &streamed, &internal.Message{Role: internal.RoleUser, Content: "hi"})
+			if err != nil {
+				t.Fatalf("TalkStream: %v", err)
+			}
+			if (*body)["stream"] != true {
+				t.Errorf("stream = %v, want true", (*body)["stream"])
+			}
+			if accept := header.Get("Accept"); accept != "text/event-stream" {
+				t.Errorf("Accept = %q", accept)
+			}
+			if streamed.String() != tt.want || result.Content != tt.want {
+				t.Errorf("streamed %q, content %q, want %q", streamed.String(), result.Content, tt.want)
+			}
+			if result.PromptTokens != 5 || result.ResponseTokens != 2 {
+				t.Errorf("tokens = %d/%d, want 5/2", result.PromptTokens, result.ResponseTokens)
+			}
+			if result.Meta == nil || result.Meta.FinishReason != internal.FinishReasonStop {
+				t.Errorf("meta = %+v, want finish reason %s", result.Meta, internal.FinishReasonStop)
+			}
+		})
+	}
+}
+
+func TestOpenAITalkStreamBadEvent(t *testing.T) {
+	ai, _, _ := openAIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\ndata: {broken\n\n")
+	})
+
+	var streamed strings.Builder
+	result, err := ai.TalkStream(context.Background(), "chat", internal.Options{}, nil, &streamed, &internal.Message{Role: internal.RoleUser, Content: "hi"})
+	if err == nil || !strings.Contains(err.Error(), "decode event") {
+		t.Fatalf("err = %v, want a decode error", err)
+	}
+	if result == nil || result.Content != "Hel" {
+		t.Errorf("result = %+v, want the content before the bad event", result)
+	}
+}
+
+func TestOpenAIError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		message    string
+		transient  bool
+		delay      time.Duration
+	}{
+		{
+			name:       "rate limited",
+			status:     http.StatusTooManyRequests,
+			retryAfter: "7",
+			body:       `{"error":{"message":"slow down","type":"rate_limit"}}`,
+			message:    "openai: slow down (429 Too Many Requests)",
+			transient:  true,
+			delay:      7 * time.Second,
+		},
+		{
+			name:      "overloaded",
+			status:    http.StatusServiceUnavailable,
+			body:      "busy",
+			message:   "openai: busy (503 Service Unavailable)",
+			transient: true,
+		},
+		{
+			name:    "bad request",
+			status:  http.StatusBadRequest,
+			body:    `{"error":{"message":"unknown model"}}`,
+			message: "openai: unknown model (400 Bad Request)",
+		},
+		{
+			name:    "empty body",
+			status:  http.StatusInternalServerError,
+			message: "openai: 500 Internal Server Error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ai, _, _ := openAIServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if len(tt.retryAfter) != 0 {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+
+			for _, stream := range []bool{false, true} {
+				var err error
+				if stream {
+					_, err = ai.TalkStream(context.Background(), "chat", internal.Options{}, nil, io.Discard, &internal.Message{Role: internal.RoleUser, Content: "hi"})
+				} else {
+					_, err = ai.Talk(context.Background(), "chat", internal.Options{}, nil, &internal.Message{Role: internal.RoleUser, Content: "hi"})
+				}
+				if err == nil || err.Error() != tt.message {
+					t.Fatalf("stream %v: err = %v, want %s", stream, err, tt.message)
+				}
+				var transient *internal.TransientError
+				if errors.As(err, &transient) != tt.transient {
+					t.Fatalf("stream %v: transient = %v, want %v", stream, !tt.transient, tt.transient)
+				}
+				if tt.transient && transient.RetryAfter != tt.delay {
+					t.Errorf("stream %v: RetryAfter = %s, want %s", stream, transient.RetryAfter, tt.delay)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package llm
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// sessionCache keeps the sessions of the most recently used conversations. It
+// holds at most capacity sessions and drops sessions which weren't used for
+// idle, the least recently used session is dropped first. It is safe for
+// concurrent use.
+type sessionCache[S any] struct {
+	mu       sync.Mutex
+	capacity int
+	idle     time.Duration
+	// lru holds the entries, the most recently used one in front
+	lru     *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type sessionEntry[S any] struct {
+	chatID   string
+	session  S
+	lastUsed time.Time
+}
+
+func newSessionCache[S any](capacity int, idle time.Duration) *sessionCache[S] {
+	return &sessionCache[S]{
+		capacity: capacity,
+		idle:     idle,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+// get returns the session of chatID and marks it as used.
+func (c *sessionCache[S]) get(chatID string) (S, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+
+	elem, ok := c.entries[chatID]
+	if !ok {
+		var zero S
+		return zero, false
+	}
+	entry := elem.Value.(*sessionEntry[S])
+	entry.lastUsed = c.now()
+	c.lru.MoveToFront(elem)
+	return entry.session, true
+}
+
+// put stores the session of chatID, it replaces the session stored before.
+func (c *sessionCache[S]) put(chatID string, session S) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[chatID]; ok {
+		entry := elem.Value.(*sessionEntry[S])
+		entry.session = session
+		entry.lastUsed = c.now()
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[chatID] = c.lru.PushFront(&sessionEntry[S]{chatID: chatID, session: session, lastUsed: c.now()})
+	c.evict()
+}
+
+// delete drops the session of chatID.
+func (c *sessionCache[S]) delete(chatID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[chatID]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, chatID)
+	}
+}
+
+// evict drops the sessions beyond the capacity and the idle ones, c.mu must be held.
+func (c *sessionCache[S]) evict() {
+	for c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		entry := elem.Value.(*sessionEntry[S])
+		if c.lru.Len() <= c.capacity && c.now().Sub(entry.lastUsed) < c.idle {
+			return
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, entry.chatID)
+	}
+}
@@ -0,0 +1,129 @@
+package llm
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is the now hook of a sessionCache, it only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestSessionCache(capacity int, idle time.Duration) (*sessionCache[string], *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache := newSessionCache[string](capacity, idle)
+	cache.now = clock.Now
+	return cache, clock
+}
+
+// cached returns the chat IDs in the cache, the most recently used one first.
+func cached(c *sessionCache[string]) []string {
+	var chatIDs []string
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		chatIDs = append(chatIDs, elem.Value.(*sessionEntry[string]).chatID)
+	}
+	return chatIDs
+}
+
+func TestSessionCacheLRU(t *testing.T) {
+	cache, _ := newTestSessionCache(2, time.Hour)
+	cache.put("a", "session a")
+	cache.put("b", "session b")
+	if session, ok := cache.get("a"); !ok || session != "session a" {
+		t.Fatalf("get(a) = %q, %v", session, ok)
+	}
+
+	// b is the least recently used session
+	cache.put("c", "session c")
+	if _, ok := cache.get("b"); ok {
+		t.Error("b is kept beyond the capacity")
+	}
+	if got := fmt.Sprint(cached(cache)); got != "[c a]" {
+		t.Errorf("cached %s, want [c a]", got)
+	}
+
+	// replacing a session marks it as used and doesn't evict
+	cache.put("a", "new session a")
+	if got := fmt.Sprint(cached(cache)); got != "[a c]" {
+		t.Errorf("cached %s, want [a c]", got)
+	}
+	if session, _ := cache.get("a"); session != "new session a" {
+		t.Errorf("get(a) = %q, want the replaced session", session)
+	}
+
+	cache.delete("a")
+	cache.delete("unknown")
+	if got := fmt.Sprint(cached(cache)); got != "[c]" || len(cache.entries) != 1 {
+		t.Errorf("cached %s with %d entries after delete, want [c]", got, len(cache.entries))
+	}
+}
+
+func TestSessionCacheIdle(t *testing.T) {
+	cache, clock := newTestSessionCache(10, time.Minute)
+	cache.put("a", "session a")
+	clock.advance(40 * time.Second)
+	cache.put("b", "session b")
+
+	// a is used just in time and kept for another minute
+	clock.advance(19 * time.Second)
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal("a is dropped before it is idle")
+	}
+
+	// b is idle now, a isn't
+	clock.advance(50 * time.Second)
+	if _, ok := cache.get("b"); ok {
+		t.Error("b is kept although it is idle")
+	}
+	if got := fmt.Sprint(cached(cache)); got != "[a]" {
+		t.Errorf("cached %s, want [a]", got)
+	}
+
+	// a put drops the idle sessions too
+	clock.advance(time.Minute)
+	cache.put("c", "session c")
+	if got := fmt.Sprint(cached(cache)); got != "[c]" || len(cache.entries) != 1 {
+		t.Errorf("cached %s with %d entries, want [c]", got, len(cache.entries))
+	}
+}
+
+// TestSessionCacheConcurrent is meant to run with -race.
+func TestSessionCacheConcurrent(t *testing.T) {
+	cache := newSessionCache[int](4, time.Minute)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				chatID := fmt.Sprintf("chat-%d", (worker+i)%6)
+				switch i % 3 {
+				case 0:
+					cache.put(chatID, i)
+				case 1:
+					cache.get(chatID)
+				case 2:
+					cache.delete(chatID)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if cache.lru.Len() > 4 || cache.lru.Len() != len(cache.entries) {
+		t.Errorf("%d sessions in the list and %d in the map, want the same at most 4", cache.lru.Len(), len(cache.entries))
+	}
+	for elem := cache.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*sessionEntry[int])
+		if cache.entries[entry.chatID] != elem {
+			t.Errorf("entry of %s is not the list element", entry.chatID)
+		}
+	}
+}
@@ -0,0 +1,654 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/mattn/go-runewidth"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+)
+
+// sgrReset ends the style of a styled piece of text.
+const sgrReset = "\x1b[0m"
+
+// textStyle is the style of a piece of rendered Markdown.
+type textStyle struct {
+	// colour is the SGR parameter of the foreground colour, e.g. "38;5;189"
+	colour    string
+	bold      bool
+	italic    bool
+	underline bool
+	strike    bool
+	// plain drops the style, the text is rendered without escape sequences
+	plain bool
+}
+
+// apply wraps s in the escape sequences of the style.
+func (st textStyle) apply(s string) string {
+	if st.plain {
+		return s
+	}
+	var params []string
+	if st.bold {
+		params = append(params, "1")
+	}
+	if st.italic {
+		params = append(params, "3")
+	}
+	if st.underline {
+		params = append(params, "4")
+	}
+	if st.strike {
+		params = append(params, "9")
+	}
+	if len(st.colour) != 0 {
+		params = append(params, st.colour)
+	}
+	if len(params) == 0 {
+		return s
+	}
+	return "\x1b[" + strings.Join(params, ";") + "m" + s + sgrReset
+}
+
+// palette holds the styles of the parts of rendered Markdown, they are taken
+// from a chroma style so the text matches the highlighted code.
+type palette struct {
+	text       textStyle
+	heading    textStyle
+	subheading textStyle
+	code       textStyle
+	link       textStyle
+	// quote is used for the bar of block quotes and the destinations of links
+	quote  textStyle
+	marker textStyle
+	border textStyle
+}
+
+// newPalette takes the palette from style in the colours of mode, plain text
+// has no styles at all.
+func newPalette(style *chroma.Style, mode ColourMode) palette {
+	if mode == ColourNone {
+		plain := textStyle{plain: true}
+		return palette{text: plain, heading: plain, subheading: plain, code: plain, link: plain, quote: plain, marker: plain, border: plain}
+	}
+	colour := func(types ...chroma.TokenType) string {
+		for _, t := range types {
+			if entry := style.Get(t); entry.Colour.IsSet() {
+				return mode.sgr(entry.Colour)
+			}
+		}
+		return ""
+	}
+	return palette{
+		text:       textStyle{colour: colour(chroma.Text)},
+		heading:    textStyle{colour: colour(chroma.GenericHeading, chroma.Keyword), bold: true},
+		subheading: textStyle{colour: colour(chroma.GenericSubheading, chroma.Keyword), bold: true},
+		code:       textStyle{colour: colour(chroma.LiteralStringBacktick, chroma.LiteralString)},
+		link:       textStyle{colour: colour(chroma.NameFunction), underline: true},
+		quote:      textStyle{colour: colour(chroma.Comment)},
+		marker:     textStyle{colour: colour(chroma.Keyword)},
+		border:     textStyle{colour: colour(chroma.Comment)},
+	}
+}
+
+// colourSGR returns the SGR parameter of the xterm 256 colour closest to c.
+func colourSGR(c chroma.Colour) string {
+	r, g, b := int(c.Red()), int(c.Green()), int(c.Blue())
+	levels := [6]int{0, 95, 135, 175, 215, 255}
+	level := func(v int) int {
+		switch {
+		case v < 48:
+			return 0
+		case v < 115:
+			return 1
+		}
+		return (v - 35) / 40
+	}
+	distance := func(r2, g2, b2 int) int {
+		return (r-r2)*(r-r2) + (g-g2)*(g-g2) + (b-b2)*(b-b2)
+	}
+
+	ri, gi, bi := level(r), level(g), level(b)
+	cube := 16 + 36*ri + 6*gi + bi
+	gray := min(max(((r+g+b)/3-3)/10, 0), 23)
+	grayValue := 8 + gray*10
+	if distance(levels[ri], levels[gi], levels[bi]) <= distance(grayValue, grayValue, grayValue) {
+		return fmt.Sprintf("38;5;%d", cube)
+	}
+	return fmt.Sprintf("38;5;%d", 232+gray)
+}
+
+// span is a piece of inline text with its style.
+type span struct {
+	text  string
+	style textStyle
+}
+
+// codeMark marks the first line of a code block in the laid out lines, it is
+// removed once the lines are complete. Markdown has no NUL characters.
+const codeMark = "\x00"
+
+// codeBlock is a code block of laid out Markdown.
+type codeBlock struct {
+	// line is the line the block starts at
+	line     int
+	language string
+	source   string
+}
+
+// layout lays out the Markdown AST of source as lines of ANSI text.
+type layout struct {
+	source    []byte
+	palette   palette
+	style     *chroma.Style
+	formatter chroma.Formatter
+	// codes are the code blocks in the order they are laid out
+	codes []codeBlock
+}
+
+// blocks lays out the block children of parent in width columns, blocks are
+// separated by a blank line unless they are the items of a tight list.
+func (l *layout) blocks(parent ast.Node, width int) []string {
+	tight := false
+	if item, ok := parent.(*ast.ListItem); ok {
+		if list, ok := item.Parent().(*ast.List); ok {
+			tight = list.IsTight
+		}
+	}
+
+	var lines []string
+	for node := parent.FirstChild(); node != nil; node = node.NextSibling() {
+		block := l.block(node, width)
+		if len(block) == 0 {
+			continue
+		}
+		if len(lines) != 0 && !tight {
+			lines = append(lines, "")
+		}
+		lines = append(lines, block...)
+	}
+	return lines
+}
+
+func (l *layout) block(node ast.Node, width int) []string {
+	switch n := node.(type) {
+	case *ast.Heading:
+		style := l.palette.heading
+		if n.Level > 1 {
+			style = l.palette.subheading
+		}
+		return wrap(l.inlines(n, style), width)
+	case *ast.Paragraph, *ast.TextBlock:
+		return wrap(l.inlines(n, l.palette.text), width)
+	case *ast.ThematicBreak:
+		return []string{l.palette.border.apply(strings.Repeat("─", width))}
+	case *ast.Blockquote:
+		bar := l.palette.quote.apply("│")
+		lines := l.blocks(n, width-2)
+		for i, line := range lines {
+			if len(line) == 0 {
+				lines[i] = bar
+			} else {
+				lines[i] = bar + " " + line
+			}
+		}
+		return lines
+	case *ast.List:
+		return l.list(n, width)
+	case *ast.FencedCodeBlock:
+		return l.code(l.lines(n), string(n.Language(l.source)), width)
+	case *ast.CodeBlock:
+		return l.code(l.lines(n), "", width)
+	case *ast.HTMLBlock:
+		source := l.lines(n)
+		if n.HasClosure() {
+			source += string(n.ClosureLine.Value(l.source))
+		}
+		return strings.Split(strings.TrimSuffix(source, "\n"), "\n")
+	case *east.Table:
+		return l.table(n, width)
+	}
+	return l.blocks(node, width)
+}
+
+// lines returns the source of the lines of a block.
+func (l *layout) lines(node ast.Node) string {
+	var b strings.Builder
+	lines := node.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		segment := lines.At(i)
+		b.Write(segment.Value(l.source))
+	}
+	return b.String()
+}
+
+// list lays out the items of list behind their bullets or numbers, the
+// content of an item is indented by the width of its marker.
+func (l *layout) list(list *ast.List, width int) []string {
+	var lines []string
+	number := list.Start
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		marker := "• "
+		if list.IsOrdered() {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		if len(lines) != 0 && !list.IsTight {
+			lines = append(lines, "")
+		}
+
+		indent := runewidth.StringWidth(marker)
+		body := l.blocks(item, width-indent)
+		if len(body) == 0 {
+			body = []string{""}
+		}
+		lines = append(lines, l.palette.marker.apply(marker)+body[0])
+		for _, line := range body[1:] {
+			if len(line) != 0 {
+				line = strings.Repeat(" ", indent) + line
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// tabWidth is the number of spaces the terminal view shows a tab as.
+const tabWidth = 4
+
+// code highlights source with the lexer of language, the lexer is guessed
+// from source if language is unknown. The code is indented and not wrapped,
+// the lines wider than width are clipped, a language is shown above it.
+// The block keeps the whole source to be copied.
+func (l *layout) code(source, language string, width int) []string {
+	var lexer chroma.Lexer
+	if len(language) != 0 {
+		lexer = lexers.Get(language)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(source)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	// the tabs are expanded to measure the lines
+	expanded := strings.ReplaceAll(source, "\t", strings.Repeat(" ", tabWidth))
+	var b strings.Builder
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, expanded)
+	if err == nil {
+		err = l.formatter.Format(&b, l.style, iterator)
+	}
+	highlighted := b.String()
+	if err != nil {
+		highlighted = expanded
+	}
+
+	var lines []string
+	if len(language) != 0 {
+		lines = append(lines, l.palette.border.apply(language))
+	}
+	code := strings.Split(highlighted, "\n")
+	// the last line holds at most the reset of the formatter
+	if last := code[len(code)-1]; visibleWidth(last) == 0 {
+		code = code[:len(code)-1]
+		if len(code) != 0 {
+			code[len(code)-1] += last
+		}
+	}
+	for _, line := range code {
+		lines = append(lines, "  "+clip(line, width-2))
+	}
+	if len(lines) != 0 {
+		lines[0] = codeMark + lines[0]
+		l.codes = append(l.codes, codeBlock{language: language, source: source})
+	}
+	return lines
+}
+
+// table lays out table in a box, the header is bold and every column is as
+// wide as its widest cell. If the table is wider than width, the widest
+// columns are narrowed and their cells wrapped, lines which still don't fit
+// are clipped.
+func (l *layout) table(table *east.Table, width int) []string {
+	type row struct {
+		cells  [][]span
+		header bool
+	}
+	var rows []row
+	var widths []int
+	for node := table.FirstChild(); node != nil; node = node.NextSibling() {
+		_, header := node.(*east.TableHeader)
+		style := l.palette.text
+		style.bold = header
+		r := row{header: header}
+		for cell := node.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			spans := l.inlines(cell, style)
+			for k := range spans {
+				spans[k].text = strings.ReplaceAll(spans[k].text, "\n", " ")
+			}
+			i := len(r.cells)
+			r.cells = append(r.cells, spans)
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], runewidth.StringWidth(plainText(spans)))
+		}
+		rows = append(rows, r)
+	}
+	// every column takes 3 columns for its padding and bar besides the first bar
+	narrow(widths, width-1-3*len(widths))
+
+	rule := func(left, middle, right string) string {
+		parts := make([]string, len(widths))
+		for i, w := range widths {
+			parts[i] = strings.Repeat("─", w+2)
+		}
+		return l.palette.border.apply(left + strings.Join(parts, middle) + right)
+	}
+	bar := l.palette.border.apply("│")
+
+	lines := []string{rule("┌", "┬", "┐")}
+	for i, r := range rows {
+		cells := make([][]string, len(widths))
+		height := 1
+		for j, w := range widths {
+			if j < len(r.cells) {
+				cells[j] = wrap(r.cells[j], w)
+			}
+			height = max(height, len(cells[j]))
+		}
+		for k := 0; k < height; k++ {
+			var b strings.Builder
+			b.WriteString(bar)
+			for j, w := range widths {
+				cell := ""
+				if k < len(cells[j]) {
+					cell = clip(cells[j][k], w)
+				}
+				alignment := east.AlignNone
+				if j < len(table.Alignments) {
+					alignment = table.Alignments[j]
+				}
+				b.WriteString(" " + pad(cell, w, alignment) + " " + bar)
+			}
+			lines = append(lines, b.String())
+		}
+		if r.header && i != len(rows)-1 {
+			lines = append(lines, rule("├", "┼", "┤"))
+		}
+	}
+	lines = append(lines, rule("└", "┴", "┘"))
+	for i, line := range lines {
+		lines[i] = clip(line, width)
+	}
+	return lines
+}
+
+// narrow narrows the widest of widths one column at a time until they take
+// at most total columns, a width is narrowed to 1 at most.
+func narrow(widths []int, total int) {
+	sum := 0
+	for _, w := range widths {
+		sum += w
+	}
+	for sum > total {
+		widest := 0
+		for i, w := range widths {
+			if w > widths[widest] {
+				widest = i
+			}
+		}
+		if widths[widest] <= 1 {
+			return
+		}
+		widths[widest]--
+		sum--
+	}
+}
+
+// pad pads the styled text s to width columns as alignment asks for.
+func pad(s string, width int, alignment east.Alignment) string {
+	space := width - visibleWidth(s)
+	switch alignment {
+	case east.AlignRight:
+		return strings.Repeat(" ", space) + s
+	case east.AlignCenter:
+		return strings.Repeat(" ", space/2) + s + strings.Repeat(" ", space-space/2)
+	}
+	return s + strings.Repeat(" ", space)
+}
+
+// inlines returns the inline children of parent as spans, style is the style
+// of the text they are part of.
+func (l *layout) inlines(parent ast.Node, style textStyle) []span {
+	var spans []span
+	for node := parent.FirstChild(); node != nil; node = node.NextSibling() {
+		spans = append(spans, l.inline(node, style)...)
+	}
+	return spans
+}
+
+func (l *layout) inline(node ast.Node, style textStyle) []span {
+	switch n := node.(type) {
+	case *ast.Text:
+		spans := []span{{text: string(n.Segment.Value(l.source)), style: style}}
+		if n.HardLineBreak() {
+			spans = append(spans, span{text: "\n", style: style})
+		} else if n.SoftLineBreak() {
+			spans = append(spans, span{text: " ", style: style})
+		}
+		return spans
+	case *ast.String:
+		return []span{{text: string(n.Value), style: style}}
+	case *ast.CodeSpan:
+		code := l.palette.code
+		code.bold, code.italic, code.strike = style.bold, style.italic, style.strike
+		return l.inlines(n, code)
+	case *ast.Emphasis:
+		if n.Level >= 2 {
+			style.bold = true
+		} else {
+			style.italic = true
+		}
+		return l.inlines(n, style)
+	case *east.Strikethrough:
+		style.strike = true
+		return l.inlines(n, style)
+	case *ast.Link:
+		link := l.palette.link
+		link.bold, link.italic, link.strike = style.bold, style.italic, style.strike
+		spans := l.inlines(n, link)
+		if destination := string(n.Destination); destination != plainText(spans) {
+			spans = append(spans, span{text: " (" + destination + ")", style: l.palette.quote})
+		}
+		return spans
+	case *ast.AutoLink:
+		return []span{{text: string(n.URL(l.source)), style: l.palette.link}}
+	case *ast.Image:
+		alt := plainText(l.inlines(n, style))
+		return []span{{text: "🖼 " + alt + " (" + string(n.Destination) + ")", style: l.palette.link}}
+	case *ast.RawHTML:
+		var b strings.Builder
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			b.Write(segment.Value(l.source))
+		}
+		return []span{{text: b.String(), style: style}}
+	case *east.TaskCheckBox:
+		if n.IsChecked {
+			return []span{{text: "☑ ", style: l.palette.marker}}
+		}
+		return []span{{text: "☐ ", style: l.palette.marker}}
+	}
+	return l.inlines(node, style)
+}
+
+// plainText returns the text of spans without their styles.
+func plainText(spans []span) string {
+	var b strings.Builder
+	for _, s := range spans {
+		b.WriteString(s.text)
+	}
+	return b.String()
+}
+
+// wrap lays out spans in lines of at most width columns. Lines are broken at
+// spaces and at hard line breaks, a word longer than a line is not split.
+func wrap(spans []span, width int) []string {
+	var (
+		lines     []string
+		line      strings.Builder
+		lineWidth int
+		word      strings.Builder
+		wordWidth int
+	)
+	endWord := func() {
+		if word.Len() == 0 {
+			return
+		}
+		if lineWidth > 0 && lineWidth+1+wordWidth > width {
+			lines = append(lines, line.String())
+			line.Reset()
+			lineWidth = 0
+		}
+		if lineWidth > 0 {
+			line.WriteByte(' ')
+			lineWidth++
+		}
+		line.WriteString(word.String())
+		lineWidth += wordWidth
+		word.Reset()
+		wordWidth = 0
+	}
+
+	for _, s := range spans {
+		for i, part := range strings.Split(s.text, "\n") {
+			if i > 0 {
+				endWord()
+				lines = append(lines, line.String())
+				line.Reset()
+				lineWidth = 0
+			}
+			for j, piece := range strings.Split(part, " ") {
+				if j > 0 {
+					endWord()
+				}
+				if len(piece) != 0 {
+					word.WriteString(s.style.apply(piece))
+					wordWidth += runewidth.StringWidth(piece)
+				}
+			}
+		}
+	}
+	endWord()
+	if lineWidth > 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// clip cuts the styled text s to width columns, an ellipsis shows that it
+// was cut. Its escape sequences are kept and the style is reset after it.
+func clip(s string, width int) string {
+	if visibleWidth(s) <= width {
+		return s
+	}
+	var b strings.Builder
+	used := 0
+	styled := false
+	for len(s) != 0 {
+		if strings.HasPrefix(s, "\x1b[") {
+			end := strings.IndexFunc(s[2:], func(r rune) bool { return r >= '@' && r <= '~' })
+			if end < 0 {
+				break
+			}
+			b.WriteString(s[:end+3])
+			s = s[end+3:]
+			styled = true
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s)
+		w := runewidth.RuneWidth(r)
+		if used+w > width-1 {
+			break
+		}
+		b.WriteRune(r)
+		used += w
+		s = s[size:]
+	}
+	if width > 0 {
+		b.WriteString("…")
+	}
+	if styled {
+		b.WriteString(sgrReset)
+	}
+	return b.String()
+}
+
+// visibleWidth returns the number of columns s takes in a terminal, escape
+// sequences take none.
+func visibleWidth(s string) int {
+	width := 0
+	for len(s) != 0 {
+		if strings.HasPrefix(s, "\x1b[") {
+			end := strings.IndexFunc(s[2:], func(r rune) bool { return r >= '@' && r <= '~' })
+			if end < 0 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+		i := strings.IndexByte(s, '\x1b')
+		if i < 0 {
+			i = len(s)
+		} else if i == 0 {
+			i = 1
+		}
+		width += runewidth.StringWidth(s[:i])
+		s = s[i:]
+	}
+	return width
+}
+
+// blockEnd returns the end of the last complete block of a Markdown text
+// which is still being written, 0 if no block is complete. A block is
+// complete once a blank line outside of a fenced code block follows it.
+func blockEnd(source []byte) int {
+	end := 0
+	offset := 0
+	content := false
+	var fence []byte
+	for {
+		i := bytes.IndexByte(source[offset:], '\n')
+		if i < 0 {
+			return end
+		}
+		line := source[offset : offset+i]
+		offset += i + 1
+
+		trimmed := bytes.TrimLeft(line, " ")
+		switch {
+		case fence != nil:
+			if len(line)-len(trimmed) <= 3 && bytes.HasPrefix(trimmed, fence) && len(bytes.TrimLeft(bytes.TrimSpace(trimmed), string(fence[:1]))) == 0 {
+				fence = nil
+			}
+		case len(line)-len(trimmed) <= 3 && (bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~"))):
+			n := len(trimmed) - len(bytes.TrimLeft(trimmed, string(trimmed[:1])))
+			fence = trimmed[:n]
+			content = true
+		case len(bytes.TrimSpace(line)) == 0:
+			if content {
+				end = offset
+				content = false
+			}
+		default:
+			content = true
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestMarkdownGolden renders testdata/markdown.md in 40 columns and compares
+// it to the golden file of every colour mode, go test -update writes them anew.
+func TestMarkdownGolden(t *testing.T) {
+	source, err := os.ReadFile(filepath.Join("testdata", "markdown.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []ColourMode{ColourNone, Colour256} {
+		t.Run(string(mode), func(t *testing.T) {
+			renderer := NewMarkdownRenderer(mode).WithStyle("catppuccin-mocha").WithWidth(40).(*MarkdownRenderer)
+			got := renderer.markdown(string(source))
+			for i, line := range strings.Split(got, "\n") {
+				if width := visibleWidth(line); width > 40 {
+					t.Errorf("line %d is %d columns wide: %q", i+1, width, line)
+				}
+			}
+
+			golden := filepath.Join("testdata", "markdown."+string(mode)+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("rendered markdown differs from %s, run go test -update to inspect it:\n%s", golden, got)
+			}
+		})
+	}
+}
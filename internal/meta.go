@@ -0,0 +1,75 @@
+package internal
+
+// finish reasons of an answer, shared by every LLM
+const (
+	FinishReasonStop       = "stop"
+	FinishReasonMaxTokens  = "max_tokens"
+	FinishReasonSafety     = "safety"
+	FinishReasonRecitation = "recitation"
+	FinishReasonOther      = "other"
+)
+
+// ResponseMeta describes how an answer came to be, apart from its content.
+type ResponseMeta struct {
+	// Blocked tells that the prompt or the answer was blocked, BlockReason tells why.
+	Blocked     bool   `json:",omitempty"`
+	BlockReason string `json:",omitempty"`
+	// FinishReason tells why the model stopped generating, one of the FinishReason constants.
+	FinishReason  string         `json:",omitempty"`
+	SafetyRatings []SafetyRating `json:",omitempty"`
+	Citations     []Citation     `json:",omitempty"`
+}
+
+// SafetyRating is the probability of an answer to be harmful in a category.
+type SafetyRating struct {
+	Category    string
+	Probability string
+	Blocked     bool `json:",omitempty"`
+}
+
+// Citation is a source an answer recites.
+type Citation struct {
+	URI        string `json:",omitempty"`
+	License    string `json:",omitempty"`
+	StartIndex int    `json:",omitempty"`
+	EndIndex   int    `json:",omitempty"`
+}
+
+// harm categories of safety settings
+const (
+	HarmCategoryHarassment       = "harassment"
+	HarmCategoryHateSpeech       = "hate_speech"
+	HarmCategorySexuallyExplicit = "sexually_explicit"
+	HarmCategoryDangerousContent = "dangerous_content"
+)
+
+// block thresholds of safety settings, from the most to the least permissive
+const (
+	BlockNone           = "block_none"
+	BlockOnlyHigh       = "block_only_high"
+	BlockMediumAndAbove = "block_medium_and_above"
+	BlockLowAndAbove    = "block_low_and_above"
+)
+
+// HarmCategories are the harm categories a safety setting can be given for.
+var HarmCategories = []string{
+	HarmCategoryHarassment,
+	HarmCategoryHateSpeech,
+	HarmCategorySexuallyExplicit,
+	HarmCategoryDangerousContent,
+}
+
+// BlockThresholds are the thresholds a safety setting can use.
+var BlockThresholds = []string{
+	BlockNone,
+	BlockOnlyHigh,
+	BlockMediumAndAbove,
+	BlockLowAndAbove,
+}
+
+// SafetySetting sets from which probability an answer of a harm category is
+// blocked. Only LLMs with safety filters, i.e. Gemini, apply them.
+type SafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
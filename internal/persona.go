@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Persona is a reusable setup of new conversations: a system prompt, which is
+// sent on every call, together with a default model and generation parameters.
+type Persona struct {
+	Name         string `json:"name"`
+	SystemPrompt string `json:"system_prompt"`
+	// Provider and Model are the default model of the persona, the default of
+	// the registry is used if they are empty.
+	Provider   string           `json:"provider,omitempty"`
+	Model      string           `json:"model,omitempty"`
+	Generation GenerationConfig `json:"generation"`
+}
+
+// ListPersonas implements tui.Backend.
+func (h *Handler) ListPersonas(ctx context.Context) ([]string, error) {
+	personas, err := h.repo.ListPersonas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(personas))
+	for _, p := range personas {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ImportPersona reads a persona in JSON from reader and saves it, a persona
+// with the same name is replaced.
+func (h *Handler) ImportPersona(ctx context.Context, reader io.Reader) (*Persona, error) {
+	var persona Persona
+	if err := json.NewDecoder(reader).Decode(&persona); err != nil {
+		return nil, fmt.Errorf("decode persona: %w", err)
+	}
+	if len(persona.Name) == 0 {
+		return nil, errors.New("persona has no name")
+	}
+	if err := h.repo.SavePersona(ctx, &persona); err != nil {
+		return nil, err
+	}
+	return &persona, nil
+}
+
+// ExportPersona writes the persona called name in JSON to writer, the output
+// can be imported again with ImportPersona.
+func (h *Handler) ExportPersona(ctx context.Context, name string, writer io.Writer) error {
+	persona, err := h.repo.GetPersona(ctx, name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(persona)
+}
+
+// DeletePersona deletes the persona called name, conversations created with
+// it keep their system prompt.
+func (h *Handler) DeletePersona(ctx context.Context, name string) error {
+	return h.repo.DeletePersona(ctx, name)
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Model is a model of a registered provider.
+type Model struct {
+	Provider string
+	Name     string
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Registry holds the LLMs geminal can talk to, LLMs are registered as providers
+// by their names. The first registered provider is the default one.
+type Registry struct {
+	mu        sync.RWMutex
+	providers []*provider
+	// default provider and model of new conversations
+	provider string
+	model    string
+}
+
+type provider struct {
+	llm LLM
+	// models offered when llm is not a ModelLister, the first one is the default
+	models []string
+}
+
+// Register adds llm as a provider, models are the models offered by llm and
+// the first one is its default model. If llm is a ModelLister, the models it
+// lists are offered as well.
+func (r *Registry) Register(llm LLM, models ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers = append(r.providers, &provider{llm: llm, models: models})
+	if len(r.provider) == 0 {
+		r.provider = llm.Name()
+		if len(models) != 0 {
+			r.model = models[0]
+		}
+	}
+}
+
+// Default returns the provider and model used by new conversations.
+func (r *Registry) Default() (provider, model string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.provider, r.model
+}
+
+// SetDefault sets the provider and model used by new conversations.
+func (r *Registry) SetDefault(provider, model string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.get(provider) == nil {
+		return fmt.Errorf("provider %q is not available", provider)
+	}
+	r.provider = provider
+	r.model = model
+	return nil
+}
+
+// LLMs returns the LLMs of every provider.
+func (r *Registry) LLMs() []LLM {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	llms := make([]LLM, 0, len(r.providers))
+	for _, p := range r.providers {
+		llms = append(llms, p.llm)
+	}
+	return llms
+}
+
+// Resolve returns the LLM of provider and the model to ask it for. The defaults
+// are used for an empty provider or model.
+func (r *Registry) Resolve(provider, model string) (LLM, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(provider) == 0 {
+		provider, model = r.provider, r.model
+	}
+	p := r.get(provider)
+	if p == nil {
+		return nil, "", fmt.Errorf("provider %q is not available, pick another model with F5", provider)
+	}
+	if len(model) == 0 && len(p.models) != 0 {
+		model = p.models[0]
+	}
+	return p.llm, model, nil
+}
+
+// Models returns the models of every provider. A provider whose models can't
+// be listed only offers the models it was registered with.
+func (r *Registry) Models(ctx context.Context) ([]*Model, error) {
+	r.mu.RLock()
+	providers := append([]*provider(nil), r.providers...)
+	r.mu.RUnlock()
+
+	var models []*Model
+	for _, p := range providers {
+		names := p.models
+		if lister, ok := p.llm.(ModelLister); ok {
+			listed, err := lister.Models(ctx)
+			if err != nil {
+				if !errors.Is(err, errors.ErrUnsupported) {
+					log.Printf("list models of %s: %v", p.llm.Name(), err)
+				}
+			} else if len(listed) != 0 {
+				names = listed
+			}
+		}
+		for _, name := range names {
+			models = append(models, &Model{Provider: p.llm.Name(), Name: name})
+		}
+	}
+	return models, nil
+}
+
+func (r *Registry) get(name string) *provider {
+	for _, p := range r.providers {
+		if p.llm.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
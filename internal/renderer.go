@@ -3,48 +3,255 @@ package internal
 import (
 	"fmt"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/chroma/v2"
-	"github.com/alecthomas/chroma/v2/formatters"
-	"github.com/alecthomas/chroma/v2/lexers"
 	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/ningzio/geminal/tui"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
 )
 
-var _ Renderer = (*ChromaRenderer)(nil)
+var _ Renderer = (*MarkdownRenderer)(nil)
 
-func NewChromaRenderer() *ChromaRenderer {
+// defaultWidth is the number of columns Markdown is laid out in.
+const defaultWidth = 80
+
+// NewMarkdownRenderer creates a Renderer which renders the Markdown of messages
+// as ANSI text in the colours of mode, the code of fenced blocks is
+// highlighted for its language.
+func NewMarkdownRenderer(mode ColourMode) *MarkdownRenderer {
+	if mode == ColourAuto {
+		mode = DetectColourMode()
+	}
 	style := styles.Get("catppuccin-mocha")
-	// style := styles.Get("gruvbox")
-	// style := styles.Get("github-dark")
-	if style == nil {
-		style = styles.Fallback
-	}
-	formatter := formatters.Get("terminal256")
-	if formatter == nil {
-		formatter = formatters.Fallback
-	}
-	return &ChromaRenderer{
-		lexer:     lexers.Markdown,
-		formatter: formatter,
+	return &MarkdownRenderer{
+		parser:    goldmark.New(goldmark.WithExtensions(extension.GFM)).Parser(),
+		formatter: mode.formatter(),
 		style:     style,
+		palette:   newPalette(style, mode),
+		mode:      mode,
+		width:     defaultWidth,
 	}
 }
 
-type ChromaRenderer struct {
-	lexer     chroma.Lexer
+// MarkdownRenderer renders headings, emphasis, lists, block quotes, links,
+// rules and tables of messages, the colours are taken from a chroma style.
+type MarkdownRenderer struct {
+	parser    parser.Parser
 	formatter chroma.Formatter
 	style     *chroma.Style
+	palette   palette
+	mode      ColourMode
+	width     int
+}
+
+// minWidth is the narrowest width Markdown is laid out in.
+const minWidth = 20
+
+// WithWidth implements Renderer.
+func (mr *MarkdownRenderer) WithWidth(width int) Renderer {
+	renderer := *mr
+	renderer.width = max(width, minWidth)
+	return &renderer
+}
+
+// WithStyle implements Renderer.
+func (mr *MarkdownRenderer) WithStyle(style string) Renderer {
+	renderer := *mr
+	renderer.style = styles.Get(style)
+	renderer.palette = newPalette(renderer.style, mr.mode)
+	return &renderer
 }
 
-// RenderMessage implements Renderer.
-func (cr *ChromaRenderer) RenderMessage(writer io.Writer, message *Message) {
-	str := fmt.Sprintf("# 🚀 %s:\n\n%s\n\n", message.Role, message.Content)
+// RenderMessage implements Renderer. The message and its code blocks are
+// marked if writer is a tui.BlockWriter.
+func (mr *MarkdownRenderer) RenderMessage(writer io.Writer, message *Message) {
+	text, codes := mr.markdownBlocks(fmt.Sprintf("# 🚀 %s:%s\n\n%s\n\n%s", message.Role, siblingIndex(message), message.Content, attachmentPlaceholders(message)))
+	if w, ok := writer.(tui.BlockWriter); ok && len(message.Content) != 0 {
+		w.MarkBlock(0, tui.Block{Label: message.Role, Source: message.Content})
+		for _, code := range codes {
+			w.MarkBlock(code.line, tui.Block{Code: true, Label: code.language, Source: code.source})
+		}
+	}
+	_, _ = io.WriteString(writer, text)
+	mr.RenderMeta(writer, message)
+}
+
+// RenderMeta implements Renderer.
+func (mr *MarkdownRenderer) RenderMeta(writer io.Writer, message *Message) {
+	notes := metaNotes(message) + usageLine(message)
+	if len(notes) == 0 {
+		return
+	}
+	// every note is a line of its own, together they would be one paragraph
+	var b strings.Builder
+	for _, note := range strings.Split(strings.TrimSuffix(notes, "\n"), "\n") {
+		b.WriteString(strings.TrimSuffix(mr.markdown(note), "\n"))
+	}
+	_, _ = io.WriteString(writer, b.String()+"\n")
+}
 
-	iterator, err := cr.lexer.Tokenise(nil, str)
-	if err != nil {
-		_, _ = writer.Write([]byte(fmt.Sprintf("render: %v", err)))
+// RenderNotice implements Renderer.
+func (mr *MarkdownRenderer) RenderNotice(writer io.Writer, notice string) {
+	mr.render(writer, fmt.Sprintf("> 🔁 %s\n", notice))
+}
+
+// RenderStream implements Renderer.
+func (mr *MarkdownRenderer) RenderStream(writer io.Writer, message *Message) io.WriteCloser {
+	mr.render(writer, fmt.Sprintf("# 🚀 %s:\n\n", message.Role))
+	return &markdownStream{renderer: mr, writer: writer}
+}
+
+func (mr *MarkdownRenderer) render(writer io.Writer, source string) {
+	_, _ = io.WriteString(writer, mr.markdown(source))
+}
+
+// markdown lays out source, the blocks are followed by a blank line. It is
+// empty if source has no blocks.
+func (mr *MarkdownRenderer) markdown(source string) string {
+	text, _ := mr.markdownBlocks(source)
+	return text
+}
+
+// markdownBlocks is markdown which also returns the code blocks of source.
+func (mr *MarkdownRenderer) markdownBlocks(source string) (string, []codeBlock) {
+	l := &layout{
+		// NUL is replaced as CommonMark says, it marks code blocks
+		source:    []byte(strings.ReplaceAll(source, "\x00", "\uFFFD")),
+		palette:   mr.palette,
+		style:     mr.style,
+		formatter: mr.formatter,
+	}
+	lines := l.blocks(mr.parser.Parse(text.NewReader(l.source)), mr.width)
+	if len(lines) == 0 {
+		return "", nil
+	}
+	next := 0
+	for i, line := range lines {
+		if j := strings.Index(line, codeMark); j >= 0 {
+			lines[i] = line[:j] + line[j+len(codeMark):]
+			l.codes[next].line = i
+			next++
+		}
+	}
+	return strings.Join(lines, "\n") + "\n\n", l.codes
+}
+
+// markdownStream renders a streamed message block by block, Markdown can't be
+// rendered before a block is complete.
+type markdownStream struct {
+	renderer *MarkdownRenderer
+	writer   io.Writer
+	pending  []byte
+}
+
+// Write implements io.Writer.
+func (s *markdownStream) Write(p []byte) (int, error) {
+	s.pending = append(s.pending, p...)
+	if end := blockEnd(s.pending); end > 0 {
+		s.renderer.render(s.writer, string(s.pending[:end]))
+		s.pending = append([]byte(nil), s.pending[end:]...)
+	}
+	return len(p), nil
+}
+
+// Close implements io.Closer, the incomplete block is rendered as it is.
+func (s *markdownStream) Close() error {
+	s.renderer.render(s.writer, string(s.pending))
+	s.pending = nil
+	return nil
+}
+
+// siblingIndex returns which of the alternatives of an answer or which of the
+// branches of a prompt is shown, it is empty if there is nothing to choose from.
+func siblingIndex(message *Message) string {
+	switch {
+	case len(message.Alternatives) > 1:
+		return fmt.Sprintf(" <%d/%d>", message.Selected+1, len(message.Alternatives))
+	case len(message.Branches) != 0:
+		return fmt.Sprintf(" <%d/%d>", message.BranchIndex+1, len(message.Branches)+1)
+	}
+	return ""
+}
+
+// attachmentPlaceholders returns a line for every attachment of message, the
+// content of the attachments is not shown.
+func attachmentPlaceholders(message *Message) string {
+	if len(message.Attachments) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, attachment := range message.Attachments {
+		fmt.Fprintf(&b, "📎 %s (%s, %s)\n", attachment.Name, attachment.MIMEType, formatSize(attachment.Size))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// usageLine returns a compact line with the time, the model, the latency and
+// the tokens of an answer, it is empty for prompts and answers saved without them.
+func usageLine(message *Message) string {
+	if message.Role == RoleUser || len(message.Model) == 0 {
+		return ""
+	}
+	parts := []string{message.CreatedAt.Format("15:04"), message.Model}
+	if message.Latency > 0 {
+		parts = append(parts, message.Latency.Round(100*time.Millisecond).String())
+	}
+	if message.PromptTokens > 0 || message.ResponseTokens > 0 {
+		parts = append(parts, fmt.Sprintf("%d → %d tokens", message.PromptTokens, message.ResponseTokens))
+	}
+	return "> 🕒 " + strings.Join(parts, " · ") + "\n"
+}
+
+// metaNotes returns the error and the response meta of message as markdown
+// block quotes, it is empty if there is nothing to report.
+func metaNotes(message *Message) string {
+	var b strings.Builder
+	if len(message.ErrMsg) != 0 {
+		fmt.Fprintf(&b, "> ⚠️ error: %s\n", message.ErrMsg)
+	}
+
+	meta := message.Meta
+	if meta == nil {
+		return b.String()
+	}
+	if meta.Blocked {
+		fmt.Fprintf(&b, "> ⛔ blocked: %s\n", meta.BlockReason)
+		for _, rating := range meta.SafetyRatings {
+			if rating.Blocked || rating.Probability == "Medium" || rating.Probability == "High" {
+				fmt.Fprintf(&b, "> - %s: %s probability\n", rating.Category, rating.Probability)
+			}
+		}
+	}
+	switch meta.FinishReason {
+	case FinishReasonMaxTokens:
+		b.WriteString("> ✂️ truncated: the answer reached the max output tokens\n")
+	case FinishReasonSafety:
+		if !meta.Blocked {
+			b.WriteString("> ⛔ stopped: the answer was flagged by the safety filters\n")
+		}
+	case FinishReasonRecitation:
+		b.WriteString("> ⚠️ stopped: the answer recited a source too closely\n")
+	case FinishReasonOther:
+		b.WriteString("> ⚠️ stopped for an unknown reason\n")
 	}
-	if err := cr.formatter.Format(writer, cr.style, iterator); err != nil {
-		_, _ = writer.Write([]byte(fmt.Sprintf("render: %v", err)))
+	if len(meta.Citations) != 0 {
+		b.WriteString("> 📚 sources:\n")
+		for i, citation := range meta.Citations {
+			source := citation.URI
+			if len(source) == 0 {
+				source = "unknown source"
+			}
+			if len(citation.License) != 0 {
+				source += " (" + citation.License + ")"
+			}
+			fmt.Fprintf(&b, "> %d. %s\n", i+1, source)
+		}
 	}
+	return b.String()
 }
@@ -3,9 +3,11 @@ package repo
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	badger "github.com/dgraph-io/badger/v4"
 	"github.com/ningzio/geminal/internal"
@@ -31,13 +33,16 @@ func NewRepository() (*Repository, error) {
 		return nil, err
 	}
 	return &Repository{
-		db: db,
+		db:            db,
+		attachmentDir: filepath.Join(geminalDir, "attachments"),
 	}, nil
 
 }
 
 type Repository struct {
 	db *badger.DB
+	// attachments are stored as files named by their digest
+	attachmentDir string
 }
 
 // DeleteConversation implements internal.Repository.
@@ -119,3 +124,127 @@ func (repo *Repository) SaveConversation(ctx context.Context, conversation *inte
 	}
 	return nil
 }
+
+var personaStoreKeyPrefix = []byte("persona:")
+
+func personaStoreKey(name string) []byte {
+	return append(personaStoreKeyPrefix, []byte(name)...)
+}
+
+// ListPersonas implements internal.Repository.
+func (repo *Repository) ListPersonas(ctx context.Context) ([]*internal.Persona, error) {
+	var personas []*internal.Persona
+	err := repo.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = personaStoreKeyPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var persona internal.Persona
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &persona)
+			})
+			if err != nil {
+				return err
+			}
+			personas = append(personas, &persona)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return personas, nil
+}
+
+// GetPersona implements internal.Repository.
+func (repo *Repository) GetPersona(ctx context.Context, name string) (*internal.Persona, error) {
+	var persona internal.Persona
+	err := repo.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(personaStoreKey(name))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &persona)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, fmt.Errorf("persona %q not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &persona, nil
+}
+
+// SavePersona implements internal.Repository.
+func (repo *Repository) SavePersona(ctx context.Context, persona *internal.Persona) error {
+	err := repo.db.Update(func(txn *badger.Txn) error {
+		data, err := json.Marshal(persona)
+		if err != nil {
+			return err
+		}
+		return txn.Set(personaStoreKey(persona.Name), data)
+	})
+	if err != nil {
+		return fmt.Errorf("saving persona: %w", err)
+	}
+	return nil
+}
+
+// DeletePersona implements internal.Repository.
+func (repo *Repository) DeletePersona(ctx context.Context, name string) error {
+	return repo.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(personaStoreKey(name))
+	})
+}
+
+// SaveAttachment implements internal.Repository.
+func (repo *Repository) SaveAttachment(ctx context.Context, digest string, data []byte) error {
+	path, err := repo.attachmentPath(digest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		// same digest, same content
+		return nil
+	}
+	if err := os.MkdirAll(repo.attachmentDir, os.ModePerm); err != nil {
+		return fmt.Errorf("saving attachment: %w", err)
+	}
+
+	f, err := os.CreateTemp(repo.attachmentDir, digest+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("saving attachment: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("saving attachment: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("saving attachment: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("saving attachment: %w", err)
+	}
+	return nil
+}
+
+// LoadAttachment implements internal.Repository.
+func (repo *Repository) LoadAttachment(ctx context.Context, digest string) ([]byte, error) {
+	path, err := repo.attachmentPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (repo *Repository) attachmentPath(digest string) (string, error) {
+	if len(digest) == 0 || strings.ContainsAny(digest, `/\.`) {
+		return "", fmt.Errorf("invalid attachment digest %q", digest)
+	}
+	return filepath.Join(repo.attachmentDir, digest), nil
+}
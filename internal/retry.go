@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TransientError is a failure of a LLM call which may succeed when the call is
+// retried, such as a rate limited or overloaded server.
+type TransientError struct {
+	Err error
+	// Status is the HTTP status of the failure.
+	Status int
+	// RetryAfter is the delay asked for by the server, zero if it asked for none.
+	RetryAfter time.Duration
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// Transient wraps err into a TransientError if status is a HTTP status code
+// worth a retry, err is returned unchanged otherwise. retryAfter is the value of
+// the Retry-After header, either seconds or a HTTP date.
+func Transient(err error, status int, retryAfter string) error {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return err
+	}
+	transient := &TransientError{Err: err, Status: status}
+	if seconds, pErr := strconv.Atoi(retryAfter); pErr == nil {
+		transient.RetryAfter = time.Duration(seconds) * time.Second
+	} else if at, pErr := http.ParseTime(retryAfter); pErr == nil {
+		transient.RetryAfter = time.Until(at)
+	}
+	return transient
+}
+
+// RetryConfig sets how failed LLM calls are retried.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts of a call including the first one,
+	// 5 by default. 1 disables retries.
+	MaxAttempts int `json:"max_attempts"`
+	// BaseDelayMS is the delay before the first retry, it doubles with every
+	// retry up to MaxDelayMS. 500ms and 30s by default.
+	BaseDelayMS int `json:"base_delay_ms"`
+	MaxDelayMS  int `json:"max_delay_ms"`
+	// RequestsPerMinute limits the calls to providers by name, providers
+	// which are not listed are not limited.
+	RequestsPerMinute map[string]int `json:"requests_per_minute"`
+}
+
+func (c RetryConfig) maxAttempts() int {
+	if c.MaxAttempts > 0 {
+		return c.MaxAttempts
+	}
+	return 5
+}
+
+func (c RetryConfig) baseDelay() time.Duration {
+	if c.BaseDelayMS > 0 {
+		return time.Duration(c.BaseDelayMS) * time.Millisecond
+	}
+	return 500 * time.Millisecond
+}
+
+func (c RetryConfig) maxDelay() time.Duration {
+	if c.MaxDelayMS > 0 {
+		return time.Duration(c.MaxDelayMS) * time.Millisecond
+	}
+	return 30 * time.Second
+}
+
+// Retry describes a retry of a failed call.
+type Retry struct {
+	// Attempt is the attempt which is about to start, the first retry is attempt 2.
+	Attempt     int
+	MaxAttempts int
+	Delay       time.Duration
+	Err         error
+}
+
+type retryNotifyKey struct{}
+
+// WithRetryNotify returns a context which makes a retrying LLM call notify
+// before it waits for the next attempt.
+func WithRetryNotify(ctx context.Context, notify func(Retry)) context.Context {
+	return context.WithValue(ctx, retryNotifyKey{}, notify)
+}
+
+func retryNotify(ctx context.Context) func(Retry) {
+	if notify, ok := ctx.Value(retryNotifyKey{}).(func(Retry)); ok {
+		return notify
+	}
+	return func(Retry) {}
+}
+
+var (
+	_ StreamLLM      = (*RetryLLM)(nil)
+	_ ModelLister    = (*RetryLLM)(nil)
+	_ TokenCounter   = (*RetryLLM)(nil)
+	_ SessionDropper = (*RetryLLM)(nil)
+)
+
+// NewRetryLLM decorates llm with retries of transient failures and the rate
+// limit of its provider in config.
+func NewRetryLLM(llm LLM, config RetryConfig) *RetryLLM {
+	return &RetryLLM{
+		llm:     llm,
+		config:  config,
+		limiter: newLimiter(config.RequestsPerMinute[llm.Name()]),
+		sleep:   sleep,
+		jitter:  rand.Float64,
+	}
+}
+
+// RetryLLM retries the calls of a LLM which fail with a TransientError, the
+// delays grow exponentially with jitter unless the server asks for a delay.
+// A stream is only retried as long as nothing of it was written.
+//
+// RetryLLM offers the optional interfaces of LLM whether the decorated LLM
+// implements them or not: TalkStream writes the whole answer at once,
+// DropSession does nothing and the others fail with errors.ErrUnsupported.
+type RetryLLM struct {
+	llm     LLM
+	config  RetryConfig
+	limiter *limiter
+	// sleep and jitter are fields to make the delays deterministic when needed
+	sleep  func(ctx context.Context, d time.Duration) error
+	jitter func() float64
+}
+
+// Name implements LLM.
+func (r *RetryLLM) Name() string {
+	return r.llm.Name()
+}
+
+// NewSession implements LLM.
+func (r *RetryLLM) NewSession(ctx context.Context, chatID string, history ...*Message) error {
+	return r.llm.NewSession(ctx, chatID, history...)
+}
+
+// DropSession implements SessionDropper.
+func (r *RetryLLM) DropSession(chatID string) {
+	if dropper, ok := r.llm.(SessionDropper); ok {
+		dropper.DropSession(chatID)
+	}
+}
+
+// Talk implements LLM.
+func (r *RetryLLM) Talk(ctx context.Context, chatID string, opts Options, history []*Message, messages ...*Message) (*Message, error) {
+	var result *Message
+	err := r.do(ctx, func() (err error) {
+		result, err = r.llm.Talk(ctx, chatID, opts, history, messages...)
+		return err
+	})
+	return result, err
+}
+
+// TalkStream implements StreamLLM.
+func (r *RetryLLM) TalkStream(ctx context.Context, chatID string, opts Options, history []*Message, writer io.Writer, messages ...*Message) (*Message, error) {
+	streamer, ok := r.llm.(StreamLLM)
+	if !ok {
+		result, err := r.Talk(ctx, chatID, opts, history, messages...)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(writer, result.Content)
+		return result, err
+	}
+
+	counter := &countingWriter{writer: writer}
+	var result *Message
+	err := r.do(ctx, func() (err error) {
+		result, err = streamer.TalkStream(ctx, chatID, opts, history, counter, messages...)
+		if err != nil && counter.n != 0 {
+			// the partial answer is shown already, a retry would repeat it
+			return permanent{err}
+		}
+		return err
+	})
+	return result, err
+}
+
+// Models implements ModelLister.
+func (r *RetryLLM) Models(ctx context.Context) ([]string, error) {
+	lister, ok := r.llm.(ModelLister)
+	if !ok {
+		return nil, fmt.Errorf("list models of %s: %w", r.Name(), errors.ErrUnsupported)
+	}
+	var models []string
+	err := r.do(ctx, func() (err error) {
+		models, err = lister.Models(ctx)
+		return err
+	})
+	return models, err
+}
+
+// CountTokens implements TokenCounter.
+func (r *RetryLLM) CountTokens(ctx context.Context, model string, messages ...*Message) (int, error) {
+	counter, ok := r.llm.(TokenCounter)
+	if !ok {
+		return 0, fmt.Errorf("count tokens of %s: %w", r.Name(), errors.ErrUnsupported)
+	}
+	var tokens int
+	err := r.do(ctx, func() (err error) {
+		tokens, err = counter.CountTokens(ctx, model, messages...)
+		return err
+	})
+	return tokens, err
+}
+
+// do calls call until it succeeds, fails with an error which is not transient
+// or runs out of attempts.
+func (r *RetryLLM) do(ctx context.Context, call func() error) error {
+	maxAttempts := r.config.maxAttempts()
+	for attempt := 1; ; attempt++ {
+		if err := r.limiter.wait(ctx, r.sleep); err != nil {
+			return err
+		}
+		err := call()
+		var p permanent
+		if errors.As(err, &p) {
+			return p.err
+		}
+		var transient *TransientError
+		if !errors.As(err, &transient) || attempt == maxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		delay := r.backoff(attempt, transient.RetryAfter)
+		log.Printf("%s: retry %d/%d in %s: %v", r.Name(), attempt+1, maxAttempts, delay, err)
+		retryNotify(ctx)(Retry{Attempt: attempt + 1, MaxAttempts: maxAttempts, Delay: delay, Err: err})
+		if err := r.sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before the retry after attempt, the delay asked
+// for by the server is preferred.
+func (r *RetryLLM) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	maxDelay := r.config.maxDelay()
+	if retryAfter > 0 {
+		return min(retryAfter, maxDelay)
+	}
+	delay := r.config.baseDelay() << (attempt - 1)
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	// full jitter in the upper half keeps concurrent retries apart
+	return delay/2 + time.Duration(r.jitter()*float64(delay/2))
+}
+
+// permanent marks an error which must not be retried even if it is transient.
+type permanent struct {
+	err error
+}
+
+func (p permanent) Error() string {
+	return p.err.Error()
+}
+
+type countingWriter struct {
+	writer io.Writer
+	n      int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.n += n
+	return n, err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// limiter spaces calls evenly to keep them below a number of requests per minute.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+	// now is replaced by tests
+	now func() time.Time
+}
+
+// newLimiter creates a limiter of rpm requests per minute, it doesn't limit if rpm is not positive.
+func newLimiter(rpm int) *limiter {
+	if rpm <= 0 {
+		return &limiter{now: time.Now}
+	}
+	return &limiter{interval: time.Minute / time.Duration(rpm), now: time.Now}
+}
+
+// wait reserves the next free slot and sleeps until it starts. If ctx is done
+// before, the slot is given back unless a later one was reserved meanwhile.
+func (l *limiter) wait(ctx context.Context, sleep func(context.Context, time.Duration) error) error {
+	if l.interval == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := l.now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	slot := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := slot.Sub(now)
+	if delay == 0 {
+		return nil
+	}
+	if err := sleep(ctx, delay); err != nil {
+		l.mu.Lock()
+		if l.next.Equal(slot.Add(l.interval)) {
+			l.next = slot
+		}
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
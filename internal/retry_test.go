@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// httpLLM answers with the body of a GET of url, a failed response is an
+// error made by Transient like the providers do.
+type httpLLM struct {
+	url string
+}
+
+func (*httpLLM) Name() string { return "fake" }
+
+func (*httpLLM) NewSession(ctx context.Context, chatID string, history ...*Message) error {
+	return nil
+}
+
+func (ai *httpLLM) Talk(ctx context.Context, chatID string, opts Options, history []*Message, messages ...*Message) (*Message, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ai.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, Transient(fmt.Errorf("fake: %s", resp.Status), resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	return &Message{ChatID: chatID, Role: ai.Name(), Content: string(body)}, nil
+}
+
+// failingServer fails the first failures requests with status and
+// retryAfter, the later ones are answered with "ok".
+func failingServer(t *testing.T, failures int, status int, retryAfter string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(requests.Add(1)) <= failures {
+			if len(retryAfter) != 0 {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// newTestRetryLLM returns a RetryLLM of server which records its delays
+// instead of sleeping, the jitter is always half of the range.
+func newTestRetryLLM(server *httptest.Server, config RetryConfig) (*RetryLLM, *[]time.Duration) {
+	r := NewRetryLLM(&httpLLM{url: server.URL}, config)
+	var delays []time.Duration
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return ctx.Err()
+	}
+	r.jitter = func() float64 { return 0.5 }
+	return r, &delays
+}
+
+func TestRetryLLM(t *testing.T) {
+	config := RetryConfig{MaxAttempts: 4, BaseDelayMS: 100, MaxDelayMS: 3000}
+	tests := []struct {
+		name       string
+		failures   int
+		status     int
+		retryAfter string
+		// attempts is the number of requests, delays the waits between them
+		attempts  int
+		delays    []time.Duration
+		transient bool
+	}{
+		{
+			name:       "retry after",
+			failures:   2,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "2",
+			attempts:   3,
+			delays:     []time.Duration{2 * time.Second, 2 * time.Second},
+		},
+		{
+			name:       "retry after above the max delay",
+			failures:   1,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "60",
+			attempts:   2,
+			delays:     []time.Duration{3 * time.Second},
+		},
+		{
+			name:     "exponential backoff",
+			failures: 3,
+			status:   http.StatusServiceUnavailable,
+			attempts: 4,
+			// half of the delay plus half of the other half as jitter
+			delays: []time.Duration{75 * time.Millisecond, 150 * time.Millisecond, 300 * time.Millisecond},
+		},
+		{
+			name:       "limit reached",
+			failures:   10,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "1",
+			attempts:   4,
+			delays:     []time.Duration{time.Second, time.Second, time.Second},
+			transient:  true,
+		},
+		{
+			name:     "not transient",
+			failures: 1,
+			status:   http.StatusBadRequest,
+			attempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := failingServer(t, tt.failures, tt.status, tt.retryAfter)
+			r, delays := newTestRetryLLM(server, config)
+
+			var retries []Retry
+			ctx := WithRetryNotify(context.Background(), func(retry Retry) {
+				retries = append(retries, retry)
+			})
+			result, err := r.Talk(ctx, "chat", Options{}, nil, &Message{Role: RoleUser, Content: "hi"})
+
+			if got := int(requests.Load()); got != tt.attempts {
+				t.Errorf("attempts = %d, want %d", got, tt.attempts)
+			}
+			if len(*delays) != len(tt.delays) || len(tt.delays) != 0 && !reflect.DeepEqual(*delays, tt.delays) {
+				t.Errorf("delays = %v, want %v", *delays, tt.delays)
+			}
+			if len(retries) != len(tt.delays) {
+				t.Fatalf("%d retries notified, want %d", len(retries), len(tt.delays))
+			}
+			for i, retry := range retries {
+				if retry.Attempt != i+2 || retry.MaxAttempts != config.MaxAttempts || retry.Delay != tt.delays[i] {
+					t.Errorf("retry %d = %+v, want attempt %d/%d in %s", i, retry, i+2, config.MaxAttempts, tt.delays[i])
+				}
+				if retry.Err == nil || !strings.Contains(retry.Err.Error(), http.StatusText(tt.status)) {
+					t.Errorf("retry %d error = %v", i, retry.Err)
+				}
+			}
+
+			failed := tt.transient || tt.status == http.StatusBadRequest
+			if failed {
+				var transient *TransientError
+				if err == nil || errors.As(err, &transient) != tt.transient {
+					t.Fatalf("err = %v, want transient %v", err, tt.transient)
+				}
+				return
+			}
+			if err != nil || result.Content != "ok" {
+				t.Fatalf("Talk = %+v, %v, want ok", result, err)
+			}
+		})
+	}
+}
+
+func TestRetryLLMCancelled(t *testing.T) {
+	server, requests := failingServer(t, 10, http.StatusTooManyRequests, "1")
+	r, _ := newTestRetryLLM(server, RetryConfig{MaxAttempts: 5})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+	_, err := r.Talk(ctx, "chat", Options{}, nil, &Message{Role: RoleUser, Content: "hi"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("attempts = %d, want 1", got)
+	}
+}
+
+// partialStreamLLM writes a part of the answer before it fails transiently.
+type partialStreamLLM struct {
+	httpLLM
+	calls int
+}
+
+func (ai *partialStreamLLM) TalkStream(ctx context.Context, chatID string, opts Options, history []*Message, writer io.Writer, messages ...*Message) (*Message, error) {
+	ai.calls++
+	io.WriteString(writer, "partial")
+	return nil, Transient(errors.New("fake: overloaded"), http.StatusServiceUnavailable, "")
+}
+
+func TestRetryLLMPartialStream(t *testing.T) {
+	llm := &partialStreamLLM{}
+	r := NewRetryLLM(llm, RetryConfig{})
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		t.Errorf("a partial stream is retried after %s", d)
+		return nil
+	}
+
+	var written strings.Builder
+	_, err := r.TalkStream(context.Background(), "chat", Options{}, nil, &written, &Message{Role: RoleUser, Content: "hi"})
+	if err == nil || err.Error() != "fake: overloaded" {
+		t.Errorf("err = %v, want the error of the stream", err)
+	}
+	if llm.calls != 1 || written.String() != "partial" {
+		t.Errorf("%d calls wrote %q, want a single call", llm.calls, written.String())
+	}
+}
+
+func TestRetryLLMStreamFallback(t *testing.T) {
+	server, requests := failingServer(t, 1, http.StatusBadGateway, "")
+	r, delays := newTestRetryLLM(server, RetryConfig{BaseDelayMS: 10})
+
+	var written strings.Builder
+	result, err := r.TalkStream(context.Background(), "chat", Options{}, nil, &written, &Message{Role: RoleUser, Content: "hi"})
+	if err != nil || result.Content != "ok" || written.String() != "ok" {
+		t.Fatalf("TalkStream = %+v, %v, wrote %q", result, err, written.String())
+	}
+	if requests.Load() != 2 || len(*delays) != 1 {
+		t.Errorf("%d attempts and delays %v, want 2 attempts and a delay", requests.Load(), *delays)
+	}
+}
+
+func TestRetryLLMRequestsPerMinute(t *testing.T) {
+	server, requests := failingServer(t, 0, http.StatusOK, "")
+	r, delays := newTestRetryLLM(server, RetryConfig{RequestsPerMinute: map[string]int{"fake": 30}})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.limiter.now = func() time.Time { return now }
+	talk := func(ctx context.Context) error {
+		_, err := r.Talk(ctx, "chat", Options{}, nil, &Message{Role: RoleUser, Content: "hi"})
+		return err
+	}
+
+	// the clock stands still, so every call waits for one more interval
+	for i := 0; i < 4; i++ {
+		if err := talk(context.Background()); err != nil {
+			t.Fatalf("Talk %d: %v", i, err)
+		}
+	}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 6 * time.Second}
+	if !reflect.DeepEqual(*delays, want) || requests.Load() != 4 {
+		t.Fatalf("%d calls waited %v, want %v", requests.Load(), *delays, want)
+	}
+
+	// a cancelled call gives its slot back
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := talk(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if err := talk(context.Background()); err != nil {
+		t.Fatalf("Talk: %v", err)
+	}
+	want = append(want, 8*time.Second, 8*time.Second)
+	if !reflect.DeepEqual(*delays, want) || requests.Load() != 5 {
+		t.Errorf("%d calls waited %v, want %v", requests.Load(), *delays, want)
+	}
+
+	// a call after the reserved slots doesn't wait
+	now = now.Add(time.Minute)
+	if err := talk(context.Background()); err != nil {
+		t.Fatalf("Talk: %v", err)
+	}
+	if len(*delays) != len(want) {
+		t.Errorf("waited %v after the slots, want no wait", (*delays)[len(want):])
+	}
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gdamore/tcell/v2"
+	"github.com/ningzio/geminal/tui"
+)
+
+// Theme pairs the chroma style messages are rendered with and the colours of
+// the interface.
+type Theme struct {
+	Name string `json:"name"`
+	// Dark tells whether the theme is meant for a dark background, the
+	// colours missing in the palette of a theme file are taken from the
+	// built-in theme of the same kind.
+	Dark bool `json:"dark"`
+	// Syntax is the name of the chroma style, e.g. monokai.
+	Syntax  string      `json:"syntax"`
+	Palette tui.Palette `json:"palette"`
+}
+
+const (
+	themeDark  = "dark"
+	themeLight = "light"
+	// themeAuto picks the dark or light theme for the background of the terminal.
+	themeAuto = "auto"
+)
+
+// builtinThemes are the themes available without theme files.
+var builtinThemes = map[string]*Theme{
+	themeDark: {
+		Name:   themeDark,
+		Dark:   true,
+		Syntax: "catppuccin-mocha",
+		Palette: tui.Palette{
+			Background:             "black",
+			ContrastBackground:     "midnightblue",
+			MoreContrastBackground: "green",
+			Border:                 "white",
+			Title:                  "white",
+			Graphics:               "white",
+			PrimaryText:            "white",
+			SecondaryText:          "yellow",
+			TertiaryText:           "green",
+			InverseText:            "blue",
+			ContrastSecondaryText:  "navy",
+			Muted:                  "darkgrey",
+		},
+	},
+	themeLight: {
+		Name:   themeLight,
+		Syntax: "catppuccin-latte",
+		Palette: tui.Palette{
+			Background:             "#eff1f5",
+			ContrastBackground:     "#ccd0da",
+			MoreContrastBackground: "#bcc0cc",
+			Border:                 "#4c4f69",
+			Title:                  "#4c4f69",
+			Graphics:               "#4c4f69",
+			PrimaryText:            "#4c4f69",
+			SecondaryText:          "#df8e1d",
+			TertiaryText:           "#40a02b",
+			InverseText:            "#1e66f5",
+			ContrastSecondaryText:  "#7287fd",
+			Muted:                  "#8c8fa1",
+		},
+	},
+}
+
+// readThemes reads the theme files in dir, every file holds one Theme in
+// JSON. It returns no themes if dir doesn't exist.
+func readThemes(dir string) ([]*Theme, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	themes := make([]*Theme, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read theme: %w", err)
+		}
+		theme := &Theme{}
+		if err := json.Unmarshal(data, theme); err != nil {
+			return nil, fmt.Errorf("parse theme %s: %w", path, err)
+		}
+		if len(theme.Name) == 0 {
+			theme.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+		}
+		if err := theme.complete(); err != nil {
+			return nil, fmt.Errorf("theme %s: %w", path, err)
+		}
+		themes = append(themes, theme)
+	}
+	return themes, nil
+}
+
+// complete fills the missing fields of t from the built-in theme of the same
+// kind and checks its colours.
+func (t *Theme) complete() error {
+	base := builtinThemes[themeLight]
+	if t.Dark {
+		base = builtinThemes[themeDark]
+	}
+	if len(t.Syntax) == 0 {
+		t.Syntax = base.Syntax
+	}
+	if _, ok := styles.Registry[t.Syntax]; !ok {
+		return fmt.Errorf("unknown syntax style %q", t.Syntax)
+	}
+	colours := []struct{ colour, base *string }{
+		{&t.Palette.Background, &base.Palette.Background},
+		{&t.Palette.ContrastBackground, &base.Palette.ContrastBackground},
+		{&t.Palette.MoreContrastBackground, &base.Palette.MoreContrastBackground},
+		{&t.Palette.Border, &base.Palette.Border},
+		{&t.Palette.Title, &base.Palette.Title},
+		{&t.Palette.Graphics, &base.Palette.Graphics},
+		{&t.Palette.PrimaryText, &base.Palette.PrimaryText},
+		{&t.Palette.SecondaryText, &base.Palette.SecondaryText},
+		{&t.Palette.TertiaryText, &base.Palette.TertiaryText},
+		{&t.Palette.InverseText, &base.Palette.InverseText},
+		{&t.Palette.ContrastSecondaryText, &base.Palette.ContrastSecondaryText},
+		{&t.Palette.Muted, &base.Palette.Muted},
+	}
+	for _, c := range colours {
+		if len(*c.colour) == 0 {
+			*c.colour = *c.base
+			continue
+		}
+		if tcell.GetColor(strings.ToLower(*c.colour)) == tcell.ColorDefault {
+			return fmt.Errorf("unknown colour %q", *c.colour)
+		}
+		*c.colour = strings.ToLower(*c.colour)
+	}
+	return nil
+}
+
+// darkBackground tells whether the terminal has a dark background. It is
+// guessed from COLORFGBG which some terminals set to "foreground;background",
+// the background is assumed dark if it is unknown.
+func darkBackground() bool {
+	colours := strings.Split(os.Getenv("COLORFGBG"), ";")
+	background, err := strconv.Atoi(colours[len(colours)-1])
+	if err != nil {
+		return true
+	}
+	// 7 is light grey and 9-15 are the bright colours
+	return background != 7 && background < 9
+}
+
+// LoadThemes adds the theme files in dir to the built-in themes, a file
+// replaces the built-in theme of the same name. The configured theme is
+// selected again from the loaded themes.
+func (h *Handler) LoadThemes(dir string) error {
+	themes, err := readThemes(dir)
+	if err != nil {
+		return err
+	}
+
+	h.themeMu.Lock()
+	defer h.themeMu.Unlock()
+	for _, theme := range themes {
+		h.themes[theme.Name] = theme
+	}
+	h.selectTheme()
+	return nil
+}
+
+// selectTheme applies the theme of the config, the dark or light theme is
+// picked for the terminal if it is "auto" or unknown. The caller holds themeMu.
+func (h *Handler) selectTheme() {
+	name := h.config.Theme
+	if _, ok := h.themes[name]; !ok {
+		if len(name) != 0 && name != themeAuto {
+			log.Printf("theme %s not found, pick one for the terminal", name)
+		}
+		name = themeLight
+		if darkBackground() {
+			name = themeDark
+		}
+	}
+	h.applyTheme(h.themes[name])
+}
+
+// applyTheme renders the messages with the syntax style of theme from now
+// on. The caller holds themeMu.
+func (h *Handler) applyTheme(theme *Theme) {
+	h.theme = theme
+	h.render = h.render.WithStyle(theme.Syntax)
+}
+
+// ListThemes implements tui.Backend.
+func (h *Handler) ListThemes(ctx context.Context) ([]string, error) {
+	h.themeMu.Lock()
+	defer h.themeMu.Unlock()
+
+	names := make([]string, 0, len(h.themes))
+	for name := range h.themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetTheme implements tui.Backend.
+func (h *Handler) GetTheme(ctx context.Context) (*tui.Theme, error) {
+	h.themeMu.Lock()
+	defer h.themeMu.Unlock()
+	return &tui.Theme{Name: h.theme.Name, Palette: h.theme.Palette}, nil
+}
+
+// SetTheme implements tui.Backend.
+func (h *Handler) SetTheme(ctx context.Context, name string) (*tui.Theme, error) {
+	h.themeMu.Lock()
+	defer h.themeMu.Unlock()
+
+	theme, ok := h.themes[name]
+	if !ok {
+		return nil, errors.New("theme not found: " + name)
+	}
+	h.applyTheme(theme)
+	return &tui.Theme{Name: theme.Name, Palette: theme.Palette}, nil
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultTitle is the title of a conversation until it gets one.
+const defaultTitle = "Untitled"
+
+// titlePrompt asks a LLM for the title of a conversation, the first message of
+// the conversation follows.
+const titlePrompt = "Write a title of at most six words for a conversation which starts with the message below. Reply with the title only, without quotes.\n\n"
+
+// maxTitleLen is the number of runes a title is cut to.
+const maxTitleLen = 48
+
+// OnTitleChanged implements tui.Backend.
+func (h *Handler) OnTitleChanged(fn func(chatID, title string)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onTitle = fn
+}
+
+// autoTitle gives the conversation chatID a title which sums up its first
+// prompt, the title is asked from llm and made up from the prompt if llm fails.
+// A conversation renamed by the user keeps its title.
+func (h *Handler) autoTitle(chatID string, llm LLM, model string, prompt *Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	title := ""
+	message := &Message{Role: RoleUser, ContentType: ContentTypeText, Content: titlePrompt + truncate(prompt.Content, 2000)}
+	if result, err := llm.Talk(ctx, "", Options{Model: model}, nil, message); err != nil {
+		log.Printf("title %s: %v", chatID, err)
+	} else {
+		title = cleanTitle(result.Content)
+	}
+	if len(title) == 0 {
+		title = titleOf(prompt.Content)
+	}
+	if len(title) == 0 {
+		return
+	}
+
+	if !h.setTitle(ctx, chatID, title) {
+		return
+	}
+	h.mu.Lock()
+	onTitle := h.onTitle
+	h.mu.Unlock()
+	if onTitle != nil {
+		onTitle(chatID, title)
+	}
+}
+
+// setTitle saves title as the title of chatID unless the conversation has a
+// title already, it reports whether the title was saved.
+func (h *Handler) setTitle(ctx context.Context, chatID, title string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		log.Printf("title %s: %v", chatID, err)
+		return false
+	}
+	if conv.Renamed || conv.Title != defaultTitle {
+		return false
+	}
+	conv.Title = title
+	if err := h.repo.SaveConversation(ctx, conv); err != nil {
+		log.Printf("title %s: %v", chatID, err)
+		return false
+	}
+	return true
+}
+
+// cleanTitle takes the title out of the answer of a LLM, it is empty if the
+// answer doesn't look like a title.
+func cleanTitle(answer string) string {
+	for _, line := range strings.Split(answer, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#*>-"))
+		line = strings.TrimPrefix(line, "Title:")
+		line = strings.Trim(strings.TrimSpace(line), "\"'`*“”.")
+		if len(line) == 0 {
+			continue
+		}
+		if utf8.RuneCountInString(line) > 2*maxTitleLen {
+			return ""
+		}
+		return truncate(line, maxTitleLen)
+	}
+	return ""
+}
+
+// titleOf makes up a title of the first words of prompt.
+func titleOf(prompt string) string {
+	for _, line := range strings.Split(prompt, "\n") {
+		words := strings.Fields(strings.Trim(line, "#*>-` "))
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) > 6 {
+			words = append(words[:6], "…")
+		}
+		return truncate(strings.Join(words, " "), maxTitleLen)
+	}
+	return ""
+}
+
+// truncate cuts s to n runes, an ellipsis marks a cut.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
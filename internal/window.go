@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ningzio/geminal/tui"
+)
+
+// strategies to fit a long history into the context window of a model
+const (
+	// StrategyDropOldest drops the oldest turns
+	StrategyDropOldest = "drop_oldest"
+	// StrategyPinned drops the oldest turns which are not pinned
+	StrategyPinned = "pinned"
+	// StrategySummarize replaces the oldest turns with a summary of them
+	StrategySummarize = "summarize"
+)
+
+// defaults of ContextConfig
+const (
+	defaultWindow  = 4096
+	defaultReserve = 1024
+)
+
+// contextWindows are the context windows of well known models by the prefix
+// of their names, the longest matching prefix wins.
+var contextWindows = map[string]int{
+	"gemini-pro":         30720,
+	"gemini-pro-vision":  12288,
+	"gpt-3.5-turbo":      16385,
+	"gpt-4":              8192,
+	"gpt-4-32k":          32768,
+	"gpt-4-1106-preview": 128000,
+	"gpt-4-turbo":        128000,
+	"llama2":             4096,
+	"mistral":            8192,
+	"mixtral":            32768,
+}
+
+// ContextConfig sets how a history which exceeds the context window of a
+// model is shortened.
+type ContextConfig struct {
+	// Strategy is one of the Strategy constants, StrategyDropOldest by default.
+	Strategy string `json:"strategy"`
+	// Windows overrides the context windows of models by name.
+	Windows map[string]int `json:"windows"`
+	// Reserve is the number of tokens kept free for the answer.
+	Reserve int `json:"reserve"`
+}
+
+// window returns the context window of model.
+func (c ContextConfig) window(model string) int {
+	if window, ok := c.Windows[model]; ok {
+		return window
+	}
+	window, matched := defaultWindow, 0
+	for prefix, w := range contextWindows {
+		if strings.HasPrefix(model, prefix) && len(prefix) > matched {
+			window, matched = w, len(prefix)
+		}
+	}
+	return window
+}
+
+func (c ContextConfig) reserve() int {
+	if c.Reserve > 0 {
+		return c.Reserve
+	}
+	return defaultReserve
+}
+
+// TokenCounter is a LLM which is able to count the tokens of messages the
+// way its model does, the tokens of other LLMs are estimated.
+type TokenCounter interface {
+	CountTokens(ctx context.Context, model string, messages ...*Message) (int, error)
+}
+
+// EstimateTokens estimates the number of tokens of text, roughly four
+// characters make a token.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// estimateMessage estimates the tokens of msg including its attachments.
+func estimateMessage(msg *Message) int {
+	tokens := EstimateTokens(msg.Content)
+	for _, attachment := range msg.Attachments {
+		if attachment.IsImage() {
+			// gemini counts an image as 258 tokens
+			tokens += 258
+		} else {
+			tokens += EstimateTokens(string(attachment.Data))
+		}
+	}
+	return tokens
+}
+
+// messageTokens returns the tokens of msg, they are estimated if they were never counted.
+func messageTokens(msg *Message) int {
+	if msg.Tokens > 0 {
+		return msg.Tokens
+	}
+	return estimateMessage(msg)
+}
+
+// countTokens counts the tokens of msg with llm and stores them on msg, they
+// are estimated if llm can't count them.
+func countTokens(ctx context.Context, llm LLM, model string, msg *Message) {
+	if counter, ok := llm.(TokenCounter); ok {
+		tokens, err := counter.CountTokens(ctx, model, msg)
+		if err == nil {
+			msg.Tokens = tokens
+			return
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("count tokens with %s: %v", llm.Name(), err)
+		}
+	}
+	msg.Tokens = estimateMessage(msg)
+}
+
+// ContextUsage implements tui.Backend.
+//
+// Used counts the whole conversation, it exceeds Limit once the history has
+// to be shortened.
+func (h *Handler) ContextUsage(ctx context.Context, chatID string) (*tui.Usage, error) {
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	_, model, err := h.registry.Resolve(conv.Provider, conv.Model)
+	if err != nil {
+		return nil, err
+	}
+	used := EstimateTokens(conv.SystemPrompt)
+	for _, msg := range conv.Messages {
+		used += messageTokens(msg)
+	}
+	return &tui.Usage{Used: used, Limit: h.config.Context.window(model)}, nil
+}
+
+// PinLastExchange implements tui.Backend.
+func (h *Handler) PinLastExchange(ctx context.Context, chatID string) (bool, error) {
+	unlock, err := h.lock(chatID)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	conv, err := h.repo.GetConversationByChatID(ctx, chatID)
+	if err != nil {
+		return false, err
+	}
+	turns := splitTurns(conv.Messages)
+	if len(turns) == 0 {
+		return false, fmt.Errorf("nothing to pin yet")
+	}
+	last := turns[len(turns)-1]
+	pin := !pinned(last)
+	for _, msg := range last {
+		msg.Pinned = pin
+	}
+	return pin, h.saveConversation(ctx, conv)
+}
+
+// Summary is a synthetic message which replaces the oldest messages of a conversation.
+type Summary struct {
+	// Covers is the number of leading messages the summary replaces.
+	Covers  int
+	Content string
+}
+
+// summaryPrompt asks a LLM to summarize a conversation.
+const summaryPrompt = "Summarize the following conversation in a few sentences. Keep facts, names, code identifiers and decisions, leave out pleasantries.\n\n"
+
+// fitHistory returns the history of conv which fits into the context window of
+// model together with message. Turns are dropped or summarized according to
+// the context strategy of the config.
+func (h *Handler) fitHistory(ctx context.Context, conv *Conversation, llm LLM, model string, message *Message) []*Message {
+	budget := h.config.Context.window(model) - h.config.Context.reserve() -
+		messageTokens(message) - EstimateTokens(conv.SystemPrompt)
+
+	total := 0
+	for _, msg := range conv.Messages {
+		total += messageTokens(msg)
+	}
+	if total <= budget {
+		return conv.Messages
+	}
+	if budget < 0 {
+		// message alone exceeds the window, dropping the history doesn't help
+		log.Printf("prompt of %s exceeds the context window of %s", conv.ChatID, model)
+		return conv.Messages
+	}
+
+	turns := splitTurns(conv.Messages)
+	switch h.config.Context.Strategy {
+	case StrategyPinned:
+		return dropTurns(turns, budget, true)
+	case StrategySummarize:
+		history, err := h.summarize(ctx, conv, llm, model, turns, budget)
+		if err == nil {
+			return history
+		}
+		log.Printf("summarize history of %s: %v", conv.ChatID, err)
+	}
+	return dropTurns(turns, budget, false)
+}
+
+// summarize drops the oldest turns until the rest fits into a quarter less
+// than budget, and puts a summary of the dropped turns in front of the rest.
+// The summary is stored in conv, it is only renewed when more turns are dropped.
+func (h *Handler) summarize(ctx context.Context, conv *Conversation, llm LLM, model string, turns [][]*Message, budget int) ([]*Message, error) {
+	kept := dropTurns(turns, budget*3/4, false)
+	covers := len(conv.Messages) - len(kept)
+
+	if conv.Summary == nil || conv.Summary.Covers < covers {
+		start := 0
+		var transcript strings.Builder
+		if conv.Summary != nil {
+			start = conv.Summary.Covers
+			fmt.Fprintf(&transcript, "Summary of the earlier conversation: %s\n\n", conv.Summary.Content)
+		}
+		for _, msg := range conv.Messages[start:covers] {
+			role := "Assistant"
+			if msg.Role == RoleUser {
+				role = "User"
+			}
+			fmt.Fprintf(&transcript, "%s: %s\n\n", role, msg.Content)
+		}
+
+		prompt := &Message{Role: RoleUser, ContentType: ContentTypeText, Content: summaryPrompt + transcript.String()}
+		result, err := llm.Talk(ctx, "", Options{Model: model}, nil, prompt)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Content) == 0 {
+			return nil, fmt.Errorf("empty summary")
+		}
+		conv.Summary = &Summary{Covers: covers, Content: result.Content}
+	}
+
+	// the summary is a turn of its own, so the roles keep alternating
+	history := []*Message{
+		{ChatID: conv.ChatID, Role: RoleUser, ContentType: ContentTypeText, Content: "Summary of our earlier conversation: " + conv.Summary.Content},
+		{ChatID: conv.ChatID, Role: llm.Name(), ContentType: ContentTypeText, Content: "OK."},
+	}
+	// the summary may cover more than what was dropped this time
+	if skip := conv.Summary.Covers - covers; skip > 0 {
+		kept = kept[min(skip, len(kept)):]
+	}
+	return append(history, kept...), nil
+}
+
+// splitTurns splits messages into turns, a turn is a message of the user
+// followed by its answers.
+func splitTurns(messages []*Message) [][]*Message {
+	var turns [][]*Message
+	for _, msg := range messages {
+		if msg.Role == RoleUser || len(turns) == 0 {
+			turns = append(turns, nil)
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], msg)
+	}
+	return turns
+}
+
+// dropTurns drops the oldest turns until the rest fits into budget. If
+// keepPinned is true, turns with a pinned message are never dropped.
+func dropTurns(turns [][]*Message, budget int, keepPinned bool) []*Message {
+	tokens := make([]int, len(turns))
+	total := 0
+	for i, turn := range turns {
+		for _, msg := range turn {
+			tokens[i] += messageTokens(msg)
+		}
+		total += tokens[i]
+	}
+
+	dropped := make([]bool, len(turns))
+	for i, turn := range turns {
+		if total <= budget {
+			break
+		}
+		if keepPinned && pinned(turn) {
+			continue
+		}
+		dropped[i] = true
+		total -= tokens[i]
+	}
+
+	var history []*Message
+	for i, turn := range turns {
+		if !dropped[i] {
+			history = append(history, turn...)
+		}
+	}
+	return history
+}
+
+func pinned(turn []*Message) bool {
+	for _, msg := range turn {
+		if msg.Pinned {
+			return true
+		}
+	}
+	return false
+}
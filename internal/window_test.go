@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// summaryLLM answers with a numbered summary and records the prompts it
+// was asked to summarize, it fails with err if set.
+type summaryLLM struct {
+	prompts []string
+	err     error
+}
+
+func (*summaryLLM) Name() string { return "summarizer" }
+
+func (*summaryLLM) NewSession(ctx context.Context, chatID string, history ...*Message) error {
+	return nil
+}
+
+func (ai *summaryLLM) Talk(ctx context.Context, chatID string, opts Options, history []*Message, messages ...*Message) (*Message, error) {
+	if ai.err != nil {
+		return nil, ai.err
+	}
+	ai.prompts = append(ai.prompts, messages[len(messages)-1].Content)
+	return &Message{Role: ai.Name(), Content: fmt.Sprintf("summary %d", len(ai.prompts))}, nil
+}
+
+// testConversation returns a conversation of turns exchanges, every
+// message counts 10 tokens. The prompts are p0, p1... and the answers a0, a1...
+func testConversation(turns int) *Conversation {
+	conv := &Conversation{ChatID: "chat"}
+	for i := 0; i < turns; i++ {
+		conv.Messages = append(conv.Messages,
+			&Message{Role: RoleUser, Content: fmt.Sprintf("p%d", i), Tokens: 10},
+			&Message{Role: "summarizer", Content: fmt.Sprintf("a%d", i), Tokens: 10},
+		)
+	}
+	return conv
+}
+
+// contents returns the contents of messages separated by spaces.
+func contents(messages []*Message) string {
+	var s []string
+	for _, msg := range messages {
+		s = append(s, msg.Content)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestDropTurns(t *testing.T) {
+	tests := []struct {
+		name       string
+		budget     int
+		pinned     []int
+		keepPinned bool
+		want       string
+	}{
+		{name: "fits", budget: 80, want: "p0 a0 p1 a1 p2 a2 p3 a3"},
+		{name: "oldest dropped", budget: 50, want: "p2 a2 p3 a3"},
+		{name: "pinned dropped", budget: 50, pinned: []int{0}, want: "p2 a2 p3 a3"},
+		{name: "pinned kept", budget: 50, pinned: []int{0}, keepPinned: true, want: "p0 a0 p3 a3"},
+		{name: "pinned exceed the budget", budget: 30, pinned: []int{0, 2, 3}, keepPinned: true, want: "p0 a0 p2 a2 p3 a3"},
+		{name: "no budget", budget: 0, pinned: []int{1}, keepPinned: true, want: "p1 a1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conv := testConversation(4)
+			for _, turn := range tt.pinned {
+				conv.Messages[2*turn+1].Pinned = true
+			}
+			if got := contents(dropTurns(splitTurns(conv.Messages), tt.budget, tt.keepPinned)); got != tt.want {
+				t.Errorf("dropTurns = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitHistory(t *testing.T) {
+	tests := []struct {
+		strategy string
+		// tokens are the tokens of the prompt, the budget of the history is
+		// 90 less them
+		tokens int
+		pinned []int
+		err    error
+		want   string
+		// prompts is the number of summaries asked for
+		prompts int
+	}{
+		{strategy: StrategyDropOldest, tokens: 10, want: "p0 a0 p1 a1 p2 a2 p3 a3"},
+		{strategy: StrategyDropOldest, tokens: 40, want: "p2 a2 p3 a3"},
+		{strategy: "", tokens: 40, want: "p2 a2 p3 a3"},
+		{strategy: StrategyPinned, tokens: 40, pinned: []int{0}, want: "p0 a0 p3 a3"},
+		{strategy: StrategyPinned, tokens: 70, pinned: []int{0, 1}, want: "p0 a0 p1 a1"},
+		// the summary leaves a quarter of the budget free
+		{strategy: StrategySummarize, tokens: 40, want: "Summary of our earlier conversation: summary 1 OK. p3 a3", prompts: 1},
+		{strategy: StrategySummarize, tokens: 40, err: errors.New("overloaded"), want: "p2 a2 p3 a3"},
+		// the prompt alone exceeds the window
+		{strategy: StrategyDropOldest, tokens: 100, want: "p0 a0 p1 a1 p2 a2 p3 a3"},
+		{strategy: StrategyPinned, tokens: 100, pinned: []int{0}, want: "p0 a0 p1 a1 p2 a2 p3 a3"},
+		{strategy: StrategySummarize, tokens: 100, want: "p0 a0 p1 a1 p2 a2 p3 a3"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.strategy, tt.tokens), func(t *testing.T) {
+			h := NewHandler(NewRegistry(), nil, NewMarkdownRenderer(ColourNone), &Config{Context: ContextConfig{
+				Strategy: tt.strategy,
+				Windows:  map[string]int{"model": 100},
+				Reserve:  10,
+			}})
+			llm := &summaryLLM{err: tt.err}
+			conv := testConversation(4)
+			for _, turn := range tt.pinned {
+				conv.Messages[2*turn].Pinned = true
+			}
+			message := &Message{Role: RoleUser, Content: "prompt", Tokens: tt.tokens}
+
+			if got := contents(h.fitHistory(context.Background(), conv, llm, "model", message)); got != tt.want {
+				t.Errorf("fitHistory = %s, want %s", got, tt.want)
+			}
+			if len(llm.prompts) != tt.prompts {
+				t.Errorf("%d summaries asked for, want %d", len(llm.prompts), tt.prompts)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	h := NewHandler(NewRegistry(), nil, NewMarkdownRenderer(ColourNone), &Config{})
+	llm := &summaryLLM{}
+	conv := testConversation(4)
+	summarize := func(budget int) string {
+		t.Helper()
+		history, err := h.summarize(context.Background(), conv, llm, "model", splitTurns(conv.Messages), budget)
+		if err != nil {
+			t.Fatalf("summarize: %v", err)
+		}
+		return contents(history)
+	}
+
+	// the summary covers the first three turns
+	want := "Summary of our earlier conversation: summary 1 OK. p3 a3"
+	if got := summarize(50); got != want {
+		t.Fatalf("history %s, want %s", got, want)
+	}
+	if conv.Summary == nil || conv.Summary.Covers != 6 {
+		t.Fatalf("summary %+v, want one covering 6 messages", conv.Summary)
+	}
+	if prompt := llm.prompts[0]; !strings.Contains(prompt, "User: p0") || !strings.Contains(prompt, "Assistant: a2") || strings.Contains(prompt, "p3") {
+		t.Errorf("summarized %q, want the first three turns", prompt)
+	}
+
+	// it is reused as long as it covers what is dropped, also beyond it
+	if got := summarize(50); got != want || len(llm.prompts) != 1 {
+		t.Errorf("history %s after %d summaries, want the summary reused", got, len(llm.prompts))
+	}
+	if got := summarize(80); got != want || len(llm.prompts) != 1 {
+		t.Errorf("history %s after %d summaries with a larger budget, want the summary reused", got, len(llm.prompts))
+	}
+
+	// it is renewed from the old one when more is dropped
+	conv.Messages = append(conv.Messages, testConversation(5).Messages[8:]...)
+	want = "Summary of our earlier conversation: summary 2 OK. p4 a4"
+	if got := summarize(50); got != want {
+		t.Errorf("history %s, want %s", got, want)
+	}
+	if conv.Summary.Covers != 8 || len(llm.prompts) != 2 {
+		t.Fatalf("summary %+v after %d summaries, want a new one covering 8 messages", conv.Summary, len(llm.prompts))
+	}
+	if prompt := llm.prompts[1]; !strings.Contains(prompt, "earlier conversation: summary 1") || !strings.Contains(prompt, "User: p3") || strings.Contains(prompt, "p0") {
+		t.Errorf("summarized %q, want the old summary and the fourth turn", prompt)
+	}
+
+	// a summary which covers all that is kept isn't followed by it
+	conv.Summary.Covers = len(conv.Messages)
+	want = "Summary of our earlier conversation: summary 2 OK."
+	if got := summarize(50); got != want || len(llm.prompts) != 2 {
+		t.Errorf("history %s after %d summaries, want only the summary", got, len(llm.prompts))
+	}
+}
@@ -2,37 +2,36 @@ package tui
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
 
-func init() {
-	tview.Styles.ContrastBackgroundColor = tcell.ColorMidnightBlue
-
-	// now is default
-	tview.Styles.PrimitiveBackgroundColor = tcell.ColorBlack
-	tview.Styles.MoreContrastBackgroundColor = tcell.ColorGreen
-	tview.Styles.BorderColor = tcell.ColorWhite
-	tview.Styles.TitleColor = tcell.ColorWhite
-	tview.Styles.GraphicsColor = tcell.ColorWhite
-	tview.Styles.PrimaryTextColor = tcell.ColorWhite
-	tview.Styles.SecondaryTextColor = tcell.ColorYellow
-	tview.Styles.TertiaryTextColor = tcell.ColorGreen
-	tview.Styles.InverseTextColor = tcell.ColorBlue
-	tview.Styles.ContrastSecondaryTextColor = tcell.ColorNavy
-}
-
 // NewApplication initializes a new Application with the given backend.
 //
 // backend: The backend to use for the Application.
 // Returns a pointer to the newly created Application and an error if there was any.
 func NewApplication(backend Backend) (*Application, error) {
+	theme, err := backend.GetTheme(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	applyPalette(theme.Palette)
+
 	app := &Application{
 		backend: backend,
 		app:     tview.NewApplication(),
 		grid:    tview.NewGrid(),
 		page:    tview.NewPages(),
+		talks:   make(map[string]*talk),
+		editing: -1,
 	}
 
 	app.initWidget()
@@ -40,28 +39,64 @@ func NewApplication(backend Backend) (*Application, error) {
 	app.setPages()
 	app.bindKeys()
 
-	convs, err := backend.ListConversation(context.Background())
-	if err != nil {
+	if err := app.loadHistory(); err != nil {
 		return nil, err
 	}
-	for _, c := range convs {
-		app.history.NewHistory(c)
-	}
+	backend.OnTitleChanged(func(chatID, title string) {
+		app.app.QueueUpdateDraw(func() {
+			app.history.SetTitle(chatID, title)
+			app.chat.SetTitle(chatID, title)
+		})
+	})
 
 	app.app.SetRoot(app.page, true).EnableMouse(true)
 	return app, nil
 }
 
+// loadHistory lists the conversations in the history widget.
+func (app *Application) loadHistory() error {
+	convs, err := app.backend.ListConversation(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, c := range convs {
+		app.history.NewHistory(c)
+	}
+	return nil
+}
+
 type Application struct {
 	backend Backend
 
-	app     *tview.Application
-	grid    *tview.Grid
-	page    *tview.Pages
-	input   InputWidget
-	chat    ChatWidget
-	history HistoryWidget
-	warning *Warning
+	app      *tview.Application
+	grid     *tview.Grid
+	page     *tview.Pages
+	input    InputWidget
+	chat     ChatWidget
+	history  HistoryWidget
+	warning  *Warning
+	models   *Picker
+	personas *Picker
+	prompts  *Picker
+	branches *Picker
+	themes   *Picker
+	// status shows the context usage of the current conversation
+	status *tview.TextView
+
+	// talks holds the in-flight requests by chat id
+	talks   map[string]*talk
+	talksMu sync.Mutex
+
+	// attachments are the paths of the files sent with the next prompt
+	attachments []string
+	// editing is the index of the prompt the input replaces, -1 if the input
+	// is a new prompt
+	editing int
+}
+
+// talk is an in-flight Backend.Talk call.
+type talk struct {
+	cancel context.CancelFunc
 }
 
 // initWidget initializes the widget in the Application struct.
@@ -72,7 +107,7 @@ type Application struct {
 // Return:
 // - error: an error object if there is an error during initialization, otherwise nil.
 func (app *Application) initWidget() error {
-	app.chat = NewChat(func() { app.app.Draw() })
+	app.chat = NewChat(func() { app.app.Draw() }, app.copied)
 	app.input = NewInputTUI(app.submitFunc())
 	app.history = NewHistoryTUI(app)
 
@@ -83,6 +118,22 @@ func (app *Application) initWidget() error {
 
  */
 
+// copied reports in the status bar that block was copied, it is called from
+// any goroutine.
+func (app *Application) copied(block Block, err error) {
+	app.app.QueueUpdateDraw(func() {
+		if err != nil {
+			app.showWarning(err)
+			return
+		}
+		kind := "message"
+		if block.Code {
+			kind = "code block"
+		}
+		app.status.SetText(fmt.Sprintf("📋 %s copied", kind))
+	})
+}
+
 // setMainLayout sets the main layout of the Application.
 //
 // It configures the grid layout of the Application's UI, adding the input,
@@ -96,7 +147,7 @@ func (app *Application) initWidget() error {
 // |         |----------|
 // |         |   input  |
 // |---------+----------|
-// | help               |
+// | help      | status |
 // +--------------------+
 func (app *Application) setMainLayout() {
 	app.grid.SetRows(-8, -2, 1).SetColumns(-2, -8)
@@ -105,10 +156,50 @@ func (app *Application) setMainLayout() {
 	app.grid.AddItem(app.history.Primitive(), 0, 0, 2, 1, 0, 0, false)
 
 	view := tview.NewTextView()
-	view.SetText("F1: history, F2: input, F3: chat, F4: new conversation")
+	view.SetText("F1: history, F2: input, F3: chat, F4: new conversation, F5: model, F6: regenerate/retry, F7/F8: alternatives, F9: edit message, F10: branches, F11: theme, Esc/Ctrl+C: cancel answer, in chat [ ]/{ }: code blocks/messages, y: copy")
 	view.SetDynamicColors(true)
-	view.SetTextColor(tcell.ColorDarkGrey)
-	app.grid.AddItem(view, 2, 0, 1, 2, 0, 0, false)
+	view.SetTextColor(mutedColor)
+
+	app.status = tview.NewTextView()
+	app.status.SetTextAlign(tview.AlignRight)
+	app.status.SetTextColor(mutedColor)
+
+	bottom := tview.NewFlex().
+		AddItem(view, 0, 1, false).
+		AddItem(app.status, 32, 0, false)
+	app.grid.AddItem(bottom, 2, 0, 1, 2, 0, 0, false)
+}
+
+// updateUsage shows the context usage of chatID in the status bar, it may be
+// called from any goroutine.
+func (app *Application) updateUsage(chatID string) {
+	go func() {
+		usage, err := app.backend.ContextUsage(context.Background(), chatID)
+		text := ""
+		if err == nil {
+			text = fmt.Sprintf("context: %s/%s tokens", formatTokens(usage.Used), formatTokens(usage.Limit))
+			if usage.Used > usage.Limit {
+				text += " (trimmed)"
+			}
+		}
+		app.app.QueueUpdateDraw(func() {
+			if app.history.GetCurrentChatID() != chatID {
+				return
+			}
+			if app.talking(chatID) {
+				text = strings.TrimSuffix("⏳ answering · "+text, " · ")
+			}
+			app.status.SetText(text)
+		})
+	}()
+}
+
+// formatTokens formats a number of tokens in a short form such as 12.3k.
+func formatTokens(tokens int) string {
+	if tokens < 1000 {
+		return strconv.Itoa(tokens)
+	}
+	return fmt.Sprintf("%.1fk", float64(tokens)/1000)
 }
 
 // setPages initializes and sets up the pages for the Application.
@@ -117,6 +208,16 @@ func (app *Application) setPages() {
 	app.page.AddPage("main", app.grid, true, true)
 	app.warning = NewWarningTUI(func() { app.page.SwitchToPage("main") })
 	app.page.AddPage("warning", app.warning.Primitive(), true, false)
+	app.models = NewPicker("Models", func() { app.page.SwitchToPage("main") })
+	app.page.AddPage("models", app.models.Primitive(), true, false)
+	app.personas = NewPicker("Personas", func() { app.page.SwitchToPage("main") })
+	app.page.AddPage("personas", app.personas.Primitive(), true, false)
+	app.prompts = NewPicker("Edit a message", func() { app.page.SwitchToPage("main") })
+	app.page.AddPage("prompts", app.prompts.Primitive(), true, false)
+	app.branches = NewPicker("Branches", func() { app.page.SwitchToPage("main") })
+	app.page.AddPage("branches", app.branches.Primitive(), true, false)
+	app.themes = NewPicker("Themes", func() { app.page.SwitchToPage("main") })
+	app.page.AddPage("themes", app.themes.Primitive(), true, false)
 }
 
 // showWarning sets the error message to the warning label, sets the button text to "ok",
@@ -130,6 +231,78 @@ func (app *Application) showWarning(err error) {
 	app.page.SwitchToPage("warning")
 }
 
+// showModelPicker lists the available models, the chosen one is used by the
+// current conversation and by the conversations created afterwards.
+func (app *Application) showModelPicker() {
+	chatID := app.history.GetCurrentChatID()
+	current := app.chat.Model()
+
+	app.models.SetLoading()
+	app.page.SwitchToPage("models")
+
+	go func() {
+		models, err := app.backend.ListModels(context.Background())
+		app.app.QueueUpdateDraw(func() {
+			if err != nil {
+				app.showWarning(err)
+				return
+			}
+			items := make([]string, 0, len(models))
+			selected := -1
+			for i, model := range models {
+				items = append(items, fmt.Sprintf("%s: %s", model.Provider, model.Name))
+				if current != nil && *current == *model {
+					selected = i
+				}
+			}
+			app.models.SetItems(items, selected, func(index int) {
+				model := models[index]
+				app.page.SwitchToPage("main")
+				if err := app.backend.SetModel(context.Background(), chatID, model.Provider, model.Name); err != nil {
+					app.showWarning(err)
+					return
+				}
+				app.chat.SetModel(chatID, model)
+			})
+		})
+	}()
+}
+
+// newConversation creates a new conversation and opens it. The user picks the
+// persona of the conversation first if there are any personas.
+func (app *Application) newConversation() {
+	create := func(persona string) {
+		conv, err := app.backend.CreateConversation(context.Background(), persona)
+		if err != nil {
+			app.showWarning(err)
+			return
+		}
+		app.history.NewHistory(conv)
+		app.chat.NewChatView(conv)
+	}
+
+	personas, err := app.backend.ListPersonas(context.Background())
+	if err != nil {
+		app.showWarning(err)
+		return
+	}
+	if len(personas) == 0 {
+		create("")
+		return
+	}
+
+	items := append([]string{"No persona"}, personas...)
+	app.personas.SetItems(items, -1, func(index int) {
+		app.page.SwitchToPage("main")
+		if index == 0 {
+			create("")
+		} else {
+			create(personas[index-1])
+		}
+	})
+	app.page.SwitchToPage("personas")
+}
+
 // bindKeys binds the key events to specific actions in the Application.
 func (app *Application) bindKeys() {
 	app.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
@@ -144,13 +317,45 @@ func (app *Application) bindKeys() {
 			app.app.SetFocus(app.chat.Primitive())
 			return nil
 		case tcell.KeyF4:
-			conv, err := app.backend.CreateConversation(context.Background())
-			if err != nil {
-				app.showWarning(err)
+			app.newConversation()
+			return nil
+		case tcell.KeyF5:
+			app.showModelPicker()
+			return nil
+		case tcell.KeyF6:
+			app.regenerate()
+			return nil
+		case tcell.KeyF7:
+			app.selectAlternative(-1)
+			return nil
+		case tcell.KeyF8:
+			app.selectAlternative(1)
+			return nil
+		case tcell.KeyF9:
+			app.showPromptPicker()
+			return nil
+		case tcell.KeyF10:
+			app.showBranchPicker()
+			return nil
+		case tcell.KeyF11:
+			app.showThemePicker()
+			return nil
+		case tcell.KeyEscape:
+			if app.input.Primitive().HasFocus() {
+				if app.editing >= 0 {
+					app.stopEditing()
+					app.input.SetText("")
+					return nil
+				}
+				app.cancelTalk(app.history.GetCurrentChatID())
+				return nil
+			}
+		case tcell.KeyCtrlC:
+			// ctrl+c quits the application unless the chat is focused
+			if app.chat.Primitive().HasFocus() {
+				app.cancelTalk(app.history.GetCurrentChatID())
 				return nil
 			}
-			app.history.NewHistory(conv)
-			app.chat.NewChatView(conv)
 		case tcell.KeyTab:
 			switch app.app.GetFocus() {
 			case app.history.Primitive():
@@ -171,13 +376,19 @@ func (app *Application) bindKeys() {
 // 1. Retrieves the current chat ID from the application's history.
 // 2. If the chat ID is empty, creates a new conversation using the application's backend.
 // 3. Updates the chat ID, creates a new chat view, and initializes a new history if necessary.
-// 4. Calls the backend's Talk method asynchronously to send the user input to the chat.
+// 4. Calls the backend's Talk method asynchronously to send the user input to the chat,
+// the call can be cancelled with cancelTalk.
 func (app *Application) submitFunc() OnUserSubmit {
 	return func(input string) {
+		if command, arg, ok := parseCommand(input); ok {
+			app.runCommand(command, arg)
+			return
+		}
+
 		chatID := app.history.GetCurrentChatID()
 		// new conversation
 		if len(chatID) == 0 {
-			conversation, err := app.backend.CreateConversation(context.Background())
+			conversation, err := app.backend.CreateConversation(context.Background(), "")
 			if err != nil {
 				app.showWarning(err)
 				return
@@ -186,13 +397,309 @@ func (app *Application) submitFunc() OnUserSubmit {
 			app.chat.NewChatView(conversation)
 			app.history.NewHistory(conversation)
 		}
+		if app.busy(chatID) {
+			// the input is kept to be sent once the answer is complete
+			app.input.SetText(input)
+			return
+		}
+		if app.editing >= 0 {
+			app.editPrompt(chatID, app.editing, input)
+			app.stopEditing()
+			return
+		}
+		attachments := app.attachments
+		app.attachments = nil
+		app.input.SetAttachments(nil)
+
+		ctx, t := app.startTalk(chatID)
+		writer := app.chat.Writer(chatID)
 		go func() {
-			// if err := app.backend.Talk(context.Background(), chatID, app.chat.Writer(chatID), input); err != nil {
-			if err := app.backend.Talk(context.Background(), chatID, app.chat.Writer(), input); err != nil {
+			defer app.updateUsage(chatID)
+			defer app.finishTalk(chatID, t)
+			if err := app.backend.Talk(ctx, chatID, writer, input, attachments...); err != nil {
+				app.app.QueueUpdateDraw(func() { app.showWarning(err) })
+			}
+			// the streamed answer is rendered anew as a whole
+			app.reloadView(chatID)
+		}()
+	}
+}
+
+// runCommand runs a command typed in the input.
+func (app *Application) runCommand(command, arg string) {
+	switch command {
+	case commandAttach:
+		if len(arg) == 0 {
+			app.showWarning(errors.New("usage: /attach <path>"))
+			return
+		}
+		path := arg
+		if rest, ok := strings.CutPrefix(path, "~/"); ok {
+			if home, err := os.UserHomeDir(); err == nil {
+				path = filepath.Join(home, rest)
+			}
+		}
+		if _, err := os.Stat(path); err != nil {
+			app.showWarning(err)
+			return
+		}
+		app.attachments = append(app.attachments, path)
+	case commandDetach:
+		app.attachments = nil
+	case commandRetry:
+		app.regenerate()
+		return
+	case commandFork:
+		upTo := 0
+		if len(arg) != 0 {
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+			if err != nil || n < 1 {
+				app.showWarning(errors.New("usage: /fork [message number]"))
+				return
+			}
+			upTo = n
+		}
+		if err := app.forkConversation(app.history.GetCurrentChatID(), upTo); err != nil {
+			app.showWarning(err)
+		}
+		return
+	case commandPin:
+		chatID := app.history.GetCurrentChatID()
+		if len(chatID) == 0 {
+			return
+		}
+		pinned, err := app.backend.PinLastExchange(context.Background(), chatID)
+		if err != nil {
+			app.showWarning(err)
+			return
+		}
+		if pinned {
+			app.status.SetText("last exchange pinned")
+		} else {
+			app.status.SetText("last exchange unpinned")
+		}
+		return
+	}
+
+	app.showAttachments()
+}
+
+// showAttachments shows the names of the staged attachments below the input.
+func (app *Application) showAttachments() {
+	names := make([]string, 0, len(app.attachments))
+	for _, path := range app.attachments {
+		names = append(names, filepath.Base(path))
+	}
+	app.input.SetAttachments(names)
+}
+
+// regenerate regenerates the last answer of the current conversation, or
+// retries it if it failed. The view is reloaded to show the new answer in
+// place of the old one.
+func (app *Application) regenerate() {
+	chatID := app.history.GetCurrentChatID()
+	if len(chatID) == 0 || app.busy(chatID) {
+		return
+	}
+	ctx, t := app.startTalk(chatID)
+	writer := app.chat.Writer(chatID)
+	go func() {
+		defer app.updateUsage(chatID)
+		defer app.finishTalk(chatID, t)
+		if err := app.backend.Regenerate(ctx, chatID, writer); err != nil {
+			app.app.QueueUpdateDraw(func() { app.showWarning(err) })
+		}
+		app.reloadView(chatID)
+	}()
+}
+
+// selectAlternative shows another alternative of the last answer of the
+// current conversation.
+func (app *Application) selectAlternative(delta int) {
+	chatID := app.history.GetCurrentChatID()
+	if len(chatID) == 0 {
+		return
+	}
+	if err := app.backend.SelectAlternative(context.Background(), chatID, delta); err != nil {
+		app.showWarning(err)
+		return
+	}
+	app.reloadView(chatID)
+	app.updateUsage(chatID)
+}
+
+// reloadView renders the conversation chatID anew, it may be called from any
+// goroutine, the widgets are changed on the UI goroutine.
+func (app *Application) reloadView(chatID string) {
+	conversation, err := app.backend.GetConversation(context.Background(), chatID)
+	app.app.QueueUpdateDraw(func() {
+		if !app.chat.HasView(chatID) {
+			// the conversation was deleted while it was answering
+			return
+		}
+		if err != nil {
+			app.showWarning(err)
+			return
+		}
+		app.chat.ReloadView(conversation)
+	})
+}
+
+// showPromptPicker lists the prompts of the current conversation, the chosen
+// one is put into the input to be edited and sent as a new branch.
+func (app *Application) showPromptPicker() {
+	chatID := app.history.GetCurrentChatID()
+	if len(chatID) == 0 {
+		return
+	}
+	app.prompts.SetLoading()
+	app.page.SwitchToPage("prompts")
+
+	go func() {
+		prompts, err := app.backend.ListPrompts(context.Background(), chatID)
+		app.app.QueueUpdateDraw(func() {
+			if err != nil {
 				app.showWarning(err)
 				return
 			}
-		}()
+			items := make([]string, 0, len(prompts))
+			for _, prompt := range prompts {
+				first, _, _ := strings.Cut(strings.TrimSpace(prompt.Content), "\n")
+				items = append(items, fmt.Sprintf("#%d %s", prompt.Index+1, first))
+			}
+			app.prompts.SetItems(items, -1, func(index int) {
+				prompt := prompts[index]
+				app.page.SwitchToPage("main")
+				app.editing = prompt.Index
+				app.input.SetText(prompt.Content)
+				app.input.SetEditing(fmt.Sprintf("editing message #%d, the answer starts a new branch", prompt.Index+1))
+				app.app.SetFocus(app.input.Primitive())
+			})
+		})
+	}()
+}
+
+func (app *Application) stopEditing() {
+	app.editing = -1
+	app.input.SetEditing("")
+}
+
+// editPrompt replaces the prompt at index of chatID with input in a new
+// branch, the view is reloaded once the answer is complete.
+func (app *Application) editPrompt(chatID string, index int, input string) {
+	ctx, t := app.startTalk(chatID)
+	writer := app.chat.Writer(chatID)
+	go func() {
+		defer app.updateUsage(chatID)
+		defer app.finishTalk(chatID, t)
+		if err := app.backend.EditPrompt(ctx, chatID, index, writer, input); err != nil {
+			app.app.QueueUpdateDraw(func() { app.showWarning(err) })
+		}
+		app.reloadView(chatID)
+	}()
+}
+
+// showBranchPicker lists the branches of the current conversation, the
+// chosen one is shown in the chat.
+func (app *Application) showBranchPicker() {
+	chatID := app.history.GetCurrentChatID()
+	if len(chatID) == 0 {
+		return
+	}
+	app.branches.SetLoading()
+	app.page.SwitchToPage("branches")
+
+	go func() {
+		branches, err := app.backend.ListBranches(context.Background(), chatID)
+		app.app.QueueUpdateDraw(func() {
+			if err != nil {
+				app.showWarning(err)
+				return
+			}
+			if len(branches) == 0 {
+				app.page.SwitchToPage("main")
+				app.showWarning(errors.New("there are no branches yet, edit a message with F9 to start one"))
+				return
+			}
+			items := make([]string, 0, len(branches))
+			current := -1
+			for i, branch := range branches {
+				mark := " "
+				if branch.Selected {
+					mark = "●"
+				}
+				items = append(items, fmt.Sprintf("%s #%d <%d/%d> %s", mark, branch.Index+1, branch.Branch+1, branch.Count, branch.Prompt))
+				if branch.Selected && current < 0 {
+					current = i
+				}
+			}
+			app.branches.SetItems(items, current, func(index int) {
+				branch := branches[index]
+				app.page.SwitchToPage("main")
+				if err := app.backend.SwitchBranch(context.Background(), chatID, branch.Index, branch.Branch); err != nil {
+					app.showWarning(err)
+					return
+				}
+				app.reloadView(chatID)
+				app.updateUsage(chatID)
+			})
+		})
+	}()
+}
+
+// startTalk registers a new in-flight request for chatID and returns
+// the context the request should run with.
+func (app *Application) startTalk(chatID string) (context.Context, *talk) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &talk{cancel: cancel}
+
+	app.talksMu.Lock()
+	app.talks[chatID] = t
+	app.talksMu.Unlock()
+	app.chat.SetStreaming(chatID, true)
+	app.updateUsage(chatID)
+	return ctx, t
+}
+
+// talking tells whether there is an in-flight request for chatID.
+func (app *Application) talking(chatID string) bool {
+	app.talksMu.Lock()
+	defer app.talksMu.Unlock()
+	_, ok := app.talks[chatID]
+	return ok
+}
+
+// busy tells whether chatID is still answering, the status bar says so if it is.
+// A conversation answers one request at a time, others answer in parallel.
+func (app *Application) busy(chatID string) bool {
+	if !app.talking(chatID) {
+		return false
+	}
+	app.status.SetText("⏳ an answer is in progress, Esc cancels it")
+	return true
+}
+
+// finishTalk releases the resources of t once its request is done.
+func (app *Application) finishTalk(chatID string, t *talk) {
+	t.cancel()
+	app.app.QueueUpdate(func() {
+		app.chat.SetStreaming(chatID, false)
+	})
+
+	app.talksMu.Lock()
+	defer app.talksMu.Unlock()
+	if app.talks[chatID] == t {
+		delete(app.talks, chatID)
+	}
+}
+
+// cancelTalk cancels the in-flight request of chatID, it does nothing if
+// there is no such request.
+func (app *Application) cancelTalk(chatID string) {
+	app.talksMu.Lock()
+	defer app.talksMu.Unlock()
+	if t, ok := app.talks[chatID]; ok {
+		t.cancel()
 	}
 }
 
@@ -203,6 +710,7 @@ func (app *Application) submitFunc() OnUserSubmit {
 // on the backend. If an error occurs during the conversation retrieval, it shows a warning and returns.
 // Otherwise, it creates a new chat view for the retrieved conversation.
 func (app *Application) OnConversationChanged(chatID string) {
+	app.stopEditing()
 	ok := app.chat.SwitchView(chatID)
 	if !ok {
 		// restore conversation from repository
@@ -213,6 +721,29 @@ func (app *Application) OnConversationChanged(chatID string) {
 		}
 		app.chat.NewChatView(conversation)
 	}
+	app.updateUsage(chatID)
+}
+
+// ForkConversation implements HistoryHandler.
+func (app *Application) ForkConversation(chatID string) error {
+	return app.forkConversation(chatID, 0)
+}
+
+// forkConversation copies the first upTo messages of chatID into a new
+// conversation and opens it, all messages are copied if upTo is 0.
+func (app *Application) forkConversation(chatID string, upTo int) error {
+	if len(chatID) == 0 {
+		return errors.New("there is no conversation to fork")
+	}
+	conversation, err := app.backend.ForkConversation(context.Background(), chatID, upTo)
+	if err != nil {
+		return err
+	}
+	app.stopEditing()
+	app.chat.NewChatView(conversation)
+	app.history.NewHistory(conversation)
+	app.updateUsage(conversation.ChatID)
+	return nil
 }
 
 // DeleteConversation deletes a conversation with the given chatID.
@@ -223,6 +754,7 @@ func (app *Application) OnConversationChanged(chatID string) {
 // Returns:
 // - error: an error if the conversation deletion fails.
 func (app *Application) DeleteConversation(chatID string) error {
+	app.cancelTalk(chatID)
 	if err := app.backend.DeleteConversation(context.Background(), chatID); err != nil {
 		return err
 	}
@@ -239,7 +771,21 @@ func (app *Application) DeleteConversation(chatID string) error {
 // Return:
 // - error: an error if the conversation renaming fails.
 func (app *Application) RenameConversation(chatID, newTitle string) error {
-	return app.backend.UpdateConversation(context.Background(), chatID, newTitle)
+	if err := app.backend.UpdateConversation(context.Background(), chatID, newTitle); err != nil {
+		return err
+	}
+	app.chat.SetTitle(chatID, newTitle)
+	return nil
+}
+
+// GetSettings returns the generation settings of a conversation.
+func (app *Application) GetSettings(chatID string) (*Settings, error) {
+	return app.backend.GetSettings(context.Background(), chatID)
+}
+
+// UpdateSettings updates the generation settings of a conversation.
+func (app *Application) UpdateSettings(chatID string, settings *Settings) error {
+	return app.backend.UpdateSettings(context.Background(), chatID, settings)
 }
 
 // Run runs the Application.
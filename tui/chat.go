@@ -1,8 +1,16 @@
 package tui
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
 
@@ -13,10 +21,17 @@ var _ ChatWidget = (*Chat)(nil)
 // It takes a function onChangeFunc as a parameter, which is a callback function
 // that will be called whenever there is a change in the Chat.
 //
+// The blocks of a view, its messages and code blocks, are selected with
+// [ and ] for code blocks and { and } for messages, y copies the raw source of
+// the selected block to the clipboard and Esc clears the selection.
+//
 // The function returns a pointer to the Chat instance.
-func NewChat(onChangeFunc func()) *Chat {
+// onCopyFunc is called with the copied block once it is copied, or with the
+// error if it can't be copied. It may be called on any goroutine.
+func NewChat(onChangeFunc func(), onCopyFunc func(block Block, err error)) *Chat {
 	return &Chat{
 		onChangeFunc: onChangeFunc,
+		onCopyFunc:   onCopyFunc,
 		views:        make(map[string]*view),
 		page:         tview.NewPages(),
 	}
@@ -24,11 +39,169 @@ func NewChat(onChangeFunc func()) *Chat {
 
 type view struct {
 	textView *tview.TextView
-	writer   io.Writer
+	writer   *viewWriter
+	model    *Model
+	title    string
+	// selected is the index of the selected block, -1 if there is none
+	selected int
+	// render renders the conversation of the view, it is rendered anew when
+	// the width of the view changes unless an answer is streaming
+	render    func(writer io.Writer, width int)
+	streaming bool
+	// keepScroll tells the changed func not to scroll to the end after the
+	// view was rendered anew
+	keepScroll atomic.Bool
+}
+
+// viewWriter writes ANSI text to a view, it knows the width of the view and
+// records the lines the blocks of the view start at.
+type viewWriter struct {
+	io.Writer
+	width atomic.Int64
+
+	mu sync.Mutex
+	// lines is the number of lines written
+	lines  int
+	blocks []markedBlock
+}
+
+// markedBlock is a Block and the line of the view it starts at.
+type markedBlock struct {
+	line  int
+	block Block
+}
+
+// Width implements WidthWriter.
+func (w *viewWriter) Width() int {
+	return int(w.width.Load())
+}
+
+func (w *viewWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.lines += bytes.Count(p, []byte("\n"))
+	w.mu.Unlock()
+	return w.Writer.Write(p)
+}
+
+// MarkBlock implements BlockWriter.
+func (w *viewWriter) MarkBlock(offset int, block Block) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.blocks = append(w.blocks, markedBlock{line: w.lines + offset, block: block})
+}
+
+// reset replaces what w knows about the written text.
+func (w *viewWriter) reset(lines int, blocks []markedBlock) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines, w.blocks = lines, blocks
+}
+
+// marked returns the blocks written so far.
+func (w *viewWriter) marked() []markedBlock {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]markedBlock(nil), w.blocks...)
+}
+
+// resize renders the view anew if width differs from the width it was
+// rendered for, the scroll position is kept. The view doesn't wrap, its
+// rows are the lines written.
+func (v *view) resize(width int) {
+	if int(v.writer.width.Swap(int64(width))) == width || v.streaming || v.render == nil {
+		return
+	}
+
+	row, _ := v.textView.GetScrollOffset()
+	_, _, _, height := v.textView.GetInnerRect()
+	lines := v.textView.GetOriginalLineCount()
+	atEnd := row+height >= lines
+
+	var b strings.Builder
+	writer := &viewWriter{Writer: &b}
+	v.render(writer, width)
+	v.keepScroll.Store(true)
+	v.textView.SetText(tview.TranslateANSI(b.String()))
+	v.writer.reset(writer.lines, writer.blocks)
+	if atEnd || lines == 0 {
+		v.textView.ScrollToEnd()
+	} else {
+		v.textView.ScrollTo(row*v.textView.GetOriginalLineCount()/lines, 0)
+	}
+}
+
+// jump selects the next block if delta is 1 or the previous one if delta is
+// -1, a code block if code is set and a message otherwise. The selected block
+// is scrolled to the top, the search starts from the view if there is no
+// selection.
+func (v *view) jump(delta int, code bool) {
+	blocks := v.writer.marked()
+	i := v.selected
+	if i < 0 || i >= len(blocks) {
+		row, _ := v.textView.GetScrollOffset()
+		if delta < 0 {
+			_, _, _, height := v.textView.GetInnerRect()
+			row += height
+		}
+		i = sort.Search(len(blocks), func(i int) bool { return blocks[i].line >= row })
+		if delta > 0 {
+			i--
+		}
+	}
+	for i += delta; i >= 0 && i < len(blocks); i += delta {
+		if blocks[i].block.Code == code {
+			v.selected = i
+			v.textView.ScrollTo(blocks[i].line, 0)
+			v.updateTitle()
+			return
+		}
+	}
+}
+
+// selection returns the selected block.
+func (v *view) selection() (Block, bool) {
+	blocks := v.writer.marked()
+	if v.selected < 0 || v.selected >= len(blocks) {
+		return Block{}, false
+	}
+	return blocks[v.selected].block, true
+}
+
+// clearSelection clears the selected block.
+func (v *view) clearSelection() {
+	v.selected = -1
+	v.updateTitle()
+}
+
+// updateTitle shows the title of the view and the selected block.
+func (v *view) updateTitle() {
+	block, ok := v.selection()
+	if !ok {
+		v.textView.SetTitle(v.title)
+		return
+	}
+	kind, nth, count := "message", 0, 0
+	if block.Code {
+		kind = "code block"
+	}
+	for i, b := range v.writer.marked() {
+		if b.block.Code == block.Code {
+			count++
+			if i <= v.selected {
+				nth++
+			}
+		}
+	}
+	label := ""
+	if len(block.Label) != 0 {
+		label = " (" + block.Label + ")"
+	}
+	v.textView.SetTitle(fmt.Sprintf("%s · %s %d/%d%s, y copies, Esc clears", v.title, kind, nth, count, label))
 }
 
 type Chat struct {
 	onChangeFunc func()
+	onCopyFunc   func(block Block, err error)
 	// current view
 	view *view
 	// ChatUI can hold multi text view, when user change
@@ -48,11 +221,18 @@ func (c *Chat) DeleteView(chatID string) {
 	c.page.RemovePage(chatID)
 }
 
-// SetTitle sets the title of the chat.
-//
-// title: the title to be set for the chat.
-func (c *Chat) SetTitle(title string) {
-	c.view.textView.SetTitle(title)
+// HasView tells whether there is a view of chatID.
+func (c *Chat) HasView(chatID string) bool {
+	_, ok := c.views[chatID]
+	return ok
+}
+
+// SetTitle sets the title of the view of chatID.
+func (c *Chat) SetTitle(chatID, title string) {
+	if view, ok := c.views[chatID]; ok {
+		view.title = title
+		view.updateTitle()
+	}
 }
 
 // NewChatView creates a new chat view for the given conversation.
@@ -63,20 +243,112 @@ func (c *Chat) SetTitle(title string) {
 // The function stores the new view in the views map, sets it as the current view, and adds it to the page.
 func (c *Chat) NewChatView(conversation *Conversation) {
 	view := newTextView(conversation.Title, c.onChangeFunc)
-	if conversation.Content != nil {
-		_, _ = view.writer.Write(conversation.Content)
+	if len(conversation.Provider) != 0 {
+		view.model = &Model{Provider: conversation.Provider, Name: conversation.Model}
+	}
+	view.textView.SetInputCapture(c.navigate(view))
+	view.render = conversation.Render
+	if view.render != nil {
+		view.render(view.writer, view.writer.Width())
 	}
 	c.views[conversation.ChatID] = view
 	c.view = view
 	c.page.AddAndSwitchToPage(conversation.ChatID, view.textView, true)
 }
 
+// ReloadView replaces the content of the view of conversation, a new view is
+// created if there is none.
+func (c *Chat) ReloadView(conversation *Conversation) {
+	view, ok := c.views[conversation.ChatID]
+	if !ok {
+		c.NewChatView(conversation)
+		return
+	}
+	view.textView.Clear()
+	view.writer.reset(0, nil)
+	view.title = conversation.Title
+	view.clearSelection()
+	view.render = conversation.Render
+	if view.render != nil {
+		view.render(view.writer, view.writer.Width())
+	}
+}
+
+// Model returns the model of the current view, nil if it is unknown.
+func (c *Chat) Model() *Model {
+	if c.view == nil {
+		return nil
+	}
+	return c.view.model
+}
+
+// SetModel sets the model of the view of chatID.
+func (c *Chat) SetModel(chatID string, model *Model) {
+	if view, ok := c.views[chatID]; ok {
+		view.model = model
+	}
+}
+
+// SetStreaming marks that an answer is being written to the view of chatID,
+// the view is not rendered anew meanwhile.
+func (c *Chat) SetStreaming(chatID string, streaming bool) {
+	if view, ok := c.views[chatID]; ok {
+		view.streaming = streaming
+	}
+}
+
+// navigate returns the input capture of view which selects and copies blocks.
+func (c *Chat) navigate(view *view) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyEscape:
+			if view.selected < 0 {
+				return event
+			}
+			view.clearSelection()
+			return nil
+		case tcell.KeyRune:
+		default:
+			return event
+		}
+
+		switch event.Rune() {
+		case ']':
+			view.jump(1, true)
+		case '[':
+			view.jump(-1, true)
+		case '}':
+			view.jump(1, false)
+		case '{':
+			view.jump(-1, false)
+		case 'y':
+			block, ok := view.selection()
+			if !ok {
+				c.onCopyFunc(block, errors.New("select a block to copy with [ ] for code blocks or { } for messages"))
+				break
+			}
+			copyToClipboard(block.Source, func(err error) {
+				c.onCopyFunc(block, err)
+			})
+		default:
+			return event
+		}
+		return nil
+	}
+}
+
 // Primitive implements Primitive.
 func (c *Chat) Primitive() tview.Primitive {
 	return c.page
 }
-func (c *Chat) Writer() io.Writer {
-	return c.view.writer
+
+// Writer returns the writer of the view of chatID, what is written to a
+// deleted view is discarded.
+func (c *Chat) Writer(chatID string) io.Writer {
+	if view, ok := c.views[chatID]; ok {
+		return view.writer
+	}
+	return io.Discard
 }
 
 func (c *Chat) SwitchView(chatId string) bool {
@@ -93,15 +365,27 @@ func newTextView(title string, onChangeFunc func()) *view {
 	textView.SetBorder(true)
 	textView.SetTitle(title)
 	textView.SetDynamicColors(true)
-	textView.SetWordWrap(true)
-	textView.SetChangedFunc(func() {
-		onChangeFunc()
-		textView.ScrollToEnd()
-	})
-	writer := tview.ANSIWriter(textView)
+	// the messages are laid out in the width of the view already, so a line
+	// written is a row of the view, the rows blocks are marked at and
+	// scrolled to
+	textView.SetWrap(false)
 
-	return &view{
+	v := &view{
 		textView: textView,
-		writer:   writer,
+		title:    title,
+		selected: -1,
+		writer:   &viewWriter{Writer: tview.ANSIWriter(textView)},
 	}
+	textView.SetChangedFunc(func() {
+		onChangeFunc()
+		if !v.keepScroll.Swap(false) {
+			textView.ScrollToEnd()
+		}
+	})
+	textView.SetDrawFunc(func(screen tcell.Screen, x, y, width, height int) (int, int, int, int) {
+		// the inner rect of the border
+		v.resize(width - 2)
+		return x + 1, y + 1, width - 2, height - 2
+	})
+	return v
 }
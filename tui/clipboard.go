@@ -0,0 +1,101 @@
+package tui
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// copyToClipboard copies text to the system clipboard and calls done with the
+// result. It asks the terminal to do it with OSC 52, which works over SSH and
+// in tmux, and runs a local clipboard command if the terminal can't be written
+// to or is known to ignore OSC 52.
+//
+// It must be called on the UI goroutine, so the OSC 52 sequence is written to
+// the terminal between two draws of the screen. The clipboard command runs in
+// a goroutine of its own, done may be called on any goroutine.
+func copyToClipboard(text string, done func(err error)) {
+	command := clipboardCommand()
+	if len(command) != 0 && ignoresOSC52() {
+		go func() { done(runClipboardCommand(command, text)) }()
+		return
+	}
+	err := writeOSC52(text)
+	if err != nil && len(command) != 0 {
+		go func() { done(runClipboardCommand(command, text)) }()
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("copy to the clipboard: %w", err)
+	}
+	done(err)
+}
+
+// ignoresOSC52 tells whether the terminal is a local one known to ignore
+// OSC 52, e.g. the terminals built on VTE and the macOS Terminal.
+func ignoresOSC52() bool {
+	if len(os.Getenv("SSH_TTY")) != 0 || len(os.Getenv("SSH_CONNECTION")) != 0 {
+		return false
+	}
+	return len(os.Getenv("VTE_VERSION")) != 0 ||
+		os.Getenv("TERM_PROGRAM") == "Apple_Terminal" ||
+		os.Getenv("TERM") == "linux"
+}
+
+// writeOSC52 writes the OSC 52 sequence which sets the clipboard to text to
+// the terminal. tmux and screen pass the sequence on to the outer terminal
+// only if it is wrapped in a DCS sequence.
+func writeOSC52(text string) error {
+	sequence := "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\a"
+	switch {
+	case len(os.Getenv("TMUX")) != 0:
+		sequence = "\x1bPtmux;" + strings.ReplaceAll(sequence, "\x1b", "\x1b\x1b") + "\x1b\\"
+	case strings.HasPrefix(os.Getenv("TERM"), "screen"):
+		sequence = "\x1bP" + sequence + "\x1b\\"
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	_, err = tty.WriteString(sequence)
+	return err
+}
+
+// clipboardCommand returns the local command which reads the clipboard
+// content from its standard input, it is empty if there is none.
+func clipboardCommand() []string {
+	var candidates [][]string
+	switch {
+	case runtime.GOOS == "darwin":
+		candidates = append(candidates, []string{"pbcopy"})
+	case len(os.Getenv("WAYLAND_DISPLAY")) != 0:
+		candidates = append(candidates, []string{"wl-copy"})
+	}
+	if len(os.Getenv("DISPLAY")) != 0 {
+		candidates = append(candidates,
+			[]string{"xclip", "-selection", "clipboard"},
+			[]string{"xsel", "--clipboard", "--input"})
+	}
+	for _, command := range candidates {
+		if _, err := exec.LookPath(command[0]); err == nil {
+			return command
+		}
+	}
+	return nil
+}
+
+// runClipboardCommand copies text with the local clipboard command. Its output
+// is not read, xclip keeps it open in the background to serve the clipboard.
+func runClipboardCommand(command []string, text string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", command[0], err)
+	}
+	return nil
+}
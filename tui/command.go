@@ -0,0 +1,34 @@
+package tui
+
+import (
+	"strings"
+)
+
+// commands which can be typed in the input instead of a prompt
+const (
+	// commandAttach stages a file which is sent with the next prompt
+	commandAttach = "/attach"
+	// commandDetach drops the staged files
+	commandDetach = "/detach"
+	// commandPin pins or unpins the last exchange, pinned exchanges are kept
+	// in the context window by the pinned strategy
+	commandPin = "/pin"
+	// commandFork copies the conversation into a new one, up to the message
+	// with the number given as argument, e.g. "/fork 3"
+	commandFork = "/fork"
+	// commandRetry sends the last prompt again, it replaces a failed answer
+	// and adds an alternative to any other answer
+	commandRetry = "/retry"
+)
+
+// parseCommand splits input into a command and its argument, ok is false if
+// input is not one of the known commands.
+func parseCommand(input string) (command, arg string, ok bool) {
+	input = strings.TrimSpace(input)
+	command, arg, _ = strings.Cut(input, " ")
+	switch command {
+	case commandAttach, commandDetach, commandPin, commandFork, commandRetry:
+		return command, strings.TrimSpace(arg), true
+	}
+	return "", "", false
+}
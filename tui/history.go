@@ -9,6 +9,9 @@ type HistoryHandler interface {
 	OnConversationChanged(chatID string)
 	DeleteConversation(chatID string) error
 	RenameConversation(chatID, newTitle string) error
+	ForkConversation(chatID string) error
+	GetSettings(chatID string) (*Settings, error)
+	UpdateSettings(chatID string, settings *Settings) error
 }
 
 const (
@@ -16,6 +19,7 @@ const (
 	pageOptions       = "options"
 	pageDeletePage    = "delete"
 	pageRenameInput   = "rename"
+	pageSettings      = "settings"
 	pageWarningModal  = "warning"
 )
 
@@ -26,6 +30,7 @@ func NewHistoryTUI(handler HistoryHandler) *History {
 	deleteConversation := newDeleteModal()
 	option := newOption()
 	input := newInputField()
+	settings := newSettingsForm()
 	warning := errorModal()
 
 	history := &History{
@@ -34,6 +39,7 @@ func NewHistoryTUI(handler HistoryHandler) *History {
 		deleteConversation: deleteConversation,
 		options:            option,
 		renameTitle:        input,
+		settings:           settings,
 		warning:            warning,
 		page:               page,
 	}
@@ -52,6 +58,7 @@ type History struct {
 	options            *tview.List
 	deleteConversation *tview.Modal
 	renameTitle        *tview.InputField
+	settings           *tview.Form
 	warning            *tview.Modal
 
 	// to organize components
@@ -66,6 +73,7 @@ func (h *History) addPages() {
 	h.page.AddPage(pageOptions, h.options, true, false)
 	h.page.AddPage(pageDeletePage, h.deleteConversation, true, false)
 	h.page.AddPage(pageRenameInput, h.renameTitle, true, false)
+	h.page.AddPage(pageSettings, h.settings, true, false)
 	h.page.AddPage(pageWarningModal, h.warning, true, false)
 }
 
@@ -77,6 +85,9 @@ func (h *History) setCallbackFunc() {
 	h.conversations.SetSelectedFunc(func(i int, s1, s2 string, r rune) {
 		h.ShowOptionPage(i, s2)
 	})
+	h.warning.SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+		h.page.SwitchToPage(pageConversations)
+	})
 }
 
 // Primitive implements Primitive.
@@ -102,6 +113,26 @@ func (h *History) GetCurrentChatID() string {
 	return chatID
 }
 
+// SetTitle sets the title of the conversation chatID in the list.
+func (h *History) SetTitle(chatID, title string) {
+	for i := 0; i < h.conversations.GetItemCount(); i++ {
+		if _, id := h.conversations.GetItemText(i); id == chatID {
+			h.conversations.SetItemText(i, title, chatID)
+			return
+		}
+	}
+}
+
+// SetCurrentChatID selects the conversation chatID in the list.
+func (h *History) SetCurrentChatID(chatID string) {
+	for i := 0; i < h.conversations.GetItemCount(); i++ {
+		if _, id := h.conversations.GetItemText(i); id == chatID {
+			h.conversations.SetCurrentItem(i)
+			return
+		}
+	}
+}
+
 // ShowOptionPage displays the option page at the specified index for the given chat ID.
 //
 // Parameters:
@@ -114,6 +145,13 @@ func (h *History) ShowOptionPage(index int, chatID string) {
 			h.ShowDeletePage(index, chatID)
 		case optionRename:
 			h.ShowRenameTitlePage(index, chatID)
+		case optionFork:
+			h.page.SwitchToPage(pageConversations)
+			if err := h.handler.ForkConversation(chatID); err != nil {
+				h.showWarning(err)
+			}
+		case optionSettings:
+			h.ShowSettingsPage(chatID)
 		case optionNothing:
 			h.page.SwitchToPage(pageConversations)
 		}
@@ -156,6 +194,37 @@ func (h *History) ShowRenameTitlePage(index int, chatID string) {
 	h.page.SwitchToPage(pageRenameInput)
 }
 
+// ShowSettingsPage displays the form which edits the generation settings of chatID.
+func (h *History) ShowSettingsPage(chatID string) {
+	settings, err := h.handler.GetSettings(chatID)
+	if err != nil {
+		h.showWarning(err)
+		return
+	}
+
+	back := func() { h.page.SwitchToPage(pageConversations) }
+	setSettingsForm(h.settings, settings)
+	h.settings.AddButton("Save", func() {
+		settings, err := parseSettingsForm(h.settings, settings.SafetyCategories)
+		if err == nil {
+			err = h.handler.UpdateSettings(chatID, settings)
+		}
+		if err != nil {
+			h.showWarning(err)
+			return
+		}
+		back()
+	})
+	h.settings.AddButton("Cancel", back)
+	h.settings.SetCancelFunc(back)
+	h.page.SwitchToPage(pageSettings)
+}
+
+func (h *History) showWarning(err error) {
+	h.warning.SetText(err.Error())
+	h.page.SwitchToPage(pageWarningModal)
+}
+
 func newInputField() *tview.InputField {
 	input := tview.NewInputField()
 	input.SetLabel("New Title: ")
@@ -174,9 +243,11 @@ func newDeleteModal() *tview.Modal {
 
 // options on conversations
 var (
-	optionDelete  = "Delete this conversation?"
-	optionRename  = "Rename this conversation?"
-	optionNothing = "Do Nothing(you can just press ESC)"
+	optionDelete   = "Delete this conversation?"
+	optionRename   = "Rename this conversation?"
+	optionFork     = "Fork this conversation"
+	optionSettings = "Generation settings"
+	optionNothing  = "Do Nothing(you can just press ESC)"
 )
 
 func newOption() *tview.List {
@@ -186,6 +257,8 @@ func newOption() *tview.List {
 
 	list.AddItem(optionDelete, "", 0, nil)
 	list.AddItem(optionRename, "", 0, nil)
+	list.AddItem(optionFork, "", 0, nil)
+	list.AddItem(optionSettings, "", 0, nil)
 	list.AddItem(optionNothing, "", 0, nil)
 
 	return list
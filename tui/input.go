@@ -2,6 +2,7 @@ package tui
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -12,8 +13,48 @@ type OnUserSubmit = func(input string)
 
 // InputTUI 负责控制用户的输入
 type InputTUI struct {
-	textArea *tview.TextArea
-	grid     *tview.Grid
+	textArea    *tview.TextArea
+	attachments *tview.TextView
+	grid        *tview.Grid
+
+	// names of the staged attachments and the label of the edited message,
+	// both are shown below the text area
+	names   []string
+	editing string
+}
+
+// SetAttachments implements InputWidget.
+func (i *InputTUI) SetAttachments(names []string) {
+	i.names = names
+	i.updateInfo()
+}
+
+// Text implements InputWidget.
+func (i *InputTUI) Text() string {
+	return i.textArea.GetText()
+}
+
+// SetText implements InputWidget.
+func (i *InputTUI) SetText(text string) {
+	i.textArea.SetText(text, true)
+}
+
+// SetEditing implements InputWidget.
+func (i *InputTUI) SetEditing(label string) {
+	i.editing = label
+	i.updateInfo()
+}
+
+func (i *InputTUI) updateInfo() {
+	highlight := colorTag(tview.Styles.SecondaryTextColor)
+	var infos []string
+	if len(i.editing) != 0 {
+		infos = append(infos, fmt.Sprintf("%s✏️ %s (Esc to cancel)", highlight, tview.Escape(i.editing)))
+	}
+	if len(i.names) != 0 {
+		infos = append(infos, fmt.Sprintf("%s📎 %s", highlight, tview.Escape(strings.Join(i.names, ", "))))
+	}
+	i.attachments.SetText(strings.Join(infos, "  "))
 }
 
 // Primitive implements Primitive.
@@ -23,19 +64,24 @@ func (i *InputTUI) Primitive() tview.Primitive {
 
 func NewInputTUI(submitFunc OnUserSubmit) *InputTUI {
 	textArea := tview.NewTextArea()
-	textArea.SetPlaceholder("Type something here...")
+	textArea.SetPlaceholder("Type something here... (/attach <path> sends a file with the next message)")
 	textArea.SetWordWrap(true)
 
 	position := tview.NewTextView().
 		SetDynamicColors(true).
 		SetTextAlign(tview.AlignRight)
 
+	attachments := tview.NewTextView().
+		SetDynamicColors(true)
+
+	highlight := colorTag(tview.Styles.SecondaryTextColor)
+	mark := colorTag(tview.Styles.TertiaryTextColor)
 	updateInfos := func() {
 		fromRow, fromColumn, toRow, toColumn := textArea.GetCursor()
 		if fromRow == toRow && fromColumn == toColumn {
-			position.SetText(fmt.Sprintf("Row: [yellow]%d[white], Column: [yellow]%d ", fromRow, fromColumn))
+			position.SetText(fmt.Sprintf("Row: %[1]s%[2]d[-], Column: %[1]s%[3]d ", highlight, fromRow, fromColumn))
 		} else {
-			position.SetText(fmt.Sprintf("[red]From[white] Row: [yellow]%d[white], Column: [yellow]%d[white] - [red]To[white] Row: [yellow]%d[white], To Column: [yellow]%d ", fromRow, fromColumn, toRow, toColumn))
+			position.SetText(fmt.Sprintf("%[1]sFrom[-] Row: %[2]s%[3]d[-], Column: %[2]s%[4]d[-] - %[1]sTo[-] Row: %[2]s%[5]d[-], To Column: %[2]s%[6]d ", mark, highlight, fromRow, fromColumn, toRow, toColumn))
 		}
 	}
 
@@ -54,12 +100,15 @@ func NewInputTUI(submitFunc OnUserSubmit) *InputTUI {
 
 	grid := tview.NewGrid().
 		SetRows(0, 1).
-		AddItem(textArea, 0, 0, 1, 1, 0, 0, true).
-		AddItem(position, 1, 0, 1, 1, 0, 0, false)
+		SetColumns(0, 0).
+		AddItem(textArea, 0, 0, 1, 2, 0, 0, true).
+		AddItem(attachments, 1, 0, 1, 1, 0, 0, false).
+		AddItem(position, 1, 1, 1, 1, 0, 0, false)
 	grid.SetBorder(true)
 
 	return &InputTUI{
-		textArea: textArea,
-		grid:     grid,
+		textArea:    textArea,
+		attachments: attachments,
+		grid:        grid,
 	}
 }
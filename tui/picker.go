@@ -0,0 +1,60 @@
+package tui
+
+import (
+	"github.com/rivo/tview"
+)
+
+// Picker is a modal list which lets the user choose one of several items,
+// e.g. a model or a persona.
+type Picker struct {
+	list *tview.List
+	flex *tview.Flex
+}
+
+// NewPicker creates a Picker with title, doneFunc is called when the picker
+// is closed without choosing an item.
+func NewPicker(title string, doneFunc func()) *Picker {
+	list := tview.NewList()
+	list.ShowSecondaryText(false)
+	list.SetBorder(true)
+	list.SetTitle(title + " (press ESC to cancel)")
+	list.SetDoneFunc(doneFunc)
+
+	flex := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(list, 0, 2, true).
+			AddItem(nil, 0, 1, false), 0, 2, true).
+		AddItem(nil, 0, 1, false)
+
+	return &Picker{list: list, flex: flex}
+}
+
+// SetLoading shows a placeholder while the items are being loaded.
+func (p *Picker) SetLoading() {
+	p.list.Clear()
+	p.list.AddItem("loading...", "", 0, nil)
+}
+
+// SetItems fills the picker with items and highlights the item at current,
+// current may be -1. selectedFunc is called with the index of the chosen item.
+func (p *Picker) SetItems(items []string, current int, selectedFunc func(index int)) {
+	p.list.Clear()
+	for i, item := range items {
+		i := i
+		text := tview.Escape(item)
+		if i == current {
+			text = colorTag(tview.Styles.TertiaryTextColor) + text + " (current)"
+		}
+		p.list.AddItem(text, "", 0, func() { selectedFunc(i) })
+	}
+	if current >= 0 {
+		p.list.SetCurrentItem(current)
+	}
+}
+
+// Primitive implements Primitive.
+func (p *Picker) Primitive() tview.Primitive {
+	return p.flex
+}
@@ -0,0 +1,124 @@
+package tui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rivo/tview"
+)
+
+// labels of the settings form
+const (
+	labelTemperature     = "Temperature"
+	labelTopP            = "Top P"
+	labelTopK            = "Top K"
+	labelMaxOutputTokens = "Max tokens"
+	labelStopSequences   = "Stop (a,b)"
+	labelCandidateCount  = "Candidates"
+)
+
+// optionDefault is the choice of a safety threshold which uses the model default
+const optionDefault = "default"
+
+func newSettingsForm() *tview.Form {
+	form := tview.NewForm()
+	form.SetBorder(true)
+	form.SetTitle("Settings (empty: model default)")
+	return form
+}
+
+// setSettingsForm fills form with the fields of settings.
+func setSettingsForm(form *tview.Form, settings *Settings) {
+	form.Clear(true)
+	form.AddInputField(labelTemperature, formatPtr(settings.Temperature), 0, nil, nil)
+	form.AddInputField(labelTopP, formatPtr(settings.TopP), 0, nil, nil)
+	form.AddInputField(labelTopK, formatPtr(settings.TopK), 0, nil, nil)
+	form.AddInputField(labelMaxOutputTokens, formatPtr(settings.MaxOutputTokens), 0, nil, nil)
+	form.AddInputField(labelStopSequences, strings.Join(settings.StopSequences, ","), 0, nil, nil)
+	form.AddInputField(labelCandidateCount, formatPtr(settings.CandidateCount), 0, nil, nil)
+
+	options := append([]string{optionDefault}, settings.SafetyThresholds...)
+	for _, category := range settings.SafetyCategories {
+		current := 0
+		for i, option := range options {
+			if option == settings.Safety[category] {
+				current = i
+			}
+		}
+		form.AddDropDown(category, options, current, nil)
+	}
+}
+
+// parseSettingsForm reads the settings from the fields of form, the safety
+// thresholds are read for categories.
+func parseSettingsForm(form *tview.Form, categories []string) (*Settings, error) {
+	text := func(label string) string {
+		return strings.TrimSpace(form.GetFormItemByLabel(label).(*tview.InputField).GetText())
+	}
+
+	var (
+		settings = &Settings{}
+		err      error
+	)
+	if settings.Temperature, err = parseFloat(labelTemperature, text(labelTemperature)); err != nil {
+		return nil, err
+	}
+	if settings.TopP, err = parseFloat(labelTopP, text(labelTopP)); err != nil {
+		return nil, err
+	}
+	if settings.TopK, err = parseInt(labelTopK, text(labelTopK)); err != nil {
+		return nil, err
+	}
+	if settings.MaxOutputTokens, err = parseInt(labelMaxOutputTokens, text(labelMaxOutputTokens)); err != nil {
+		return nil, err
+	}
+	if settings.CandidateCount, err = parseInt(labelCandidateCount, text(labelCandidateCount)); err != nil {
+		return nil, err
+	}
+	for _, stop := range strings.Split(text(labelStopSequences), ",") {
+		if stop = strings.TrimSpace(stop); len(stop) != 0 {
+			settings.StopSequences = append(settings.StopSequences, stop)
+		}
+	}
+
+	settings.Safety = make(map[string]string, len(categories))
+	for _, category := range categories {
+		_, threshold := form.GetFormItemByLabel(category).(*tview.DropDown).GetCurrentOption()
+		if threshold != optionDefault {
+			settings.Safety[category] = threshold
+		}
+	}
+	return settings, nil
+}
+
+func formatPtr[T float32 | int32](v *T) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(*v)
+}
+
+func parseFloat(label, text string) (*float32, error) {
+	if len(text) == 0 {
+		return nil, nil
+	}
+	v, err := strconv.ParseFloat(text, 32)
+	if err != nil || v < 0 {
+		return nil, fmt.Errorf("%s must be a positive number", label)
+	}
+	f := float32(v)
+	return &f, nil
+}
+
+func parseInt(label, text string) (*int32, error) {
+	if len(text) == 0 {
+		return nil, nil
+	}
+	v, err := strconv.ParseInt(text, 10, 32)
+	if err != nil || v <= 0 {
+		return nil, fmt.Errorf("%s must be a positive integer", label)
+	}
+	i := int32(v)
+	return &i, nil
+}
@@ -0,0 +1,113 @@
+package tui
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// mutedColor is the colour of the key help and the status bar.
+var mutedColor = tcell.ColorDarkGrey
+
+// applyPalette sets the colours of the primitives created afterwards, the
+// colours missing in palette are kept.
+func applyPalette(palette Palette) {
+	set := func(color *tcell.Color, name string) {
+		if len(name) != 0 {
+			*color = tcell.GetColor(name)
+		}
+	}
+	set(&tview.Styles.PrimitiveBackgroundColor, palette.Background)
+	set(&tview.Styles.ContrastBackgroundColor, palette.ContrastBackground)
+	set(&tview.Styles.MoreContrastBackgroundColor, palette.MoreContrastBackground)
+	set(&tview.Styles.BorderColor, palette.Border)
+	set(&tview.Styles.TitleColor, palette.Title)
+	set(&tview.Styles.GraphicsColor, palette.Graphics)
+	set(&tview.Styles.PrimaryTextColor, palette.PrimaryText)
+	set(&tview.Styles.SecondaryTextColor, palette.SecondaryText)
+	set(&tview.Styles.TertiaryTextColor, palette.TertiaryText)
+	set(&tview.Styles.InverseTextColor, palette.InverseText)
+	set(&tview.Styles.ContrastSecondaryTextColor, palette.ContrastSecondaryText)
+	set(&mutedColor, palette.Muted)
+}
+
+// colorTag returns the style tag which sets the text colour to color.
+func colorTag(color tcell.Color) string {
+	return "[" + color.CSS() + "]"
+}
+
+// showThemePicker lists the themes, the chosen one is applied at once.
+func (app *Application) showThemePicker() {
+	app.themes.SetLoading()
+	app.page.SwitchToPage("themes")
+
+	go func() {
+		names, err := app.backend.ListThemes(context.Background())
+		current, _ := app.backend.GetTheme(context.Background())
+		app.app.QueueUpdateDraw(func() {
+			if err != nil {
+				app.showWarning(err)
+				return
+			}
+			selected := -1
+			for i, name := range names {
+				if current != nil && current.Name == name {
+					selected = i
+				}
+			}
+			app.themes.SetItems(names, selected, func(index int) {
+				app.page.SwitchToPage("main")
+				if err := app.setTheme(names[index]); err != nil {
+					app.showWarning(err)
+				}
+			})
+		})
+	}()
+}
+
+// setTheme switches to the theme name. tview copies the colours into the
+// primitives when they are created, so the widgets are created anew with the
+// new colours and the open conversations are rendered again.
+func (app *Application) setTheme(name string) error {
+	app.talksMu.Lock()
+	talking := len(app.talks) != 0
+	app.talksMu.Unlock()
+	if talking {
+		return errors.New("the theme can't be changed while an answer is in progress")
+	}
+
+	theme, err := app.backend.SetTheme(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	applyPalette(theme.Palette)
+	return app.rebuild()
+}
+
+// rebuild creates the widgets anew, the current conversation, the input and
+// the staged attachments are kept.
+func (app *Application) rebuild() error {
+	chatID := app.history.GetCurrentChatID()
+	input := app.input.Text()
+	app.editing = -1
+
+	app.grid = tview.NewGrid()
+	app.initWidget()
+	app.setMainLayout()
+	app.setPages()
+	if err := app.loadHistory(); err != nil {
+		return err
+	}
+	if len(chatID) != 0 {
+		app.history.SetCurrentChatID(chatID)
+	}
+
+	app.input.SetText(input)
+	app.showAttachments()
+
+	app.app.SetRoot(app.page, true)
+	app.app.SetFocus(app.input.Primitive())
+	return nil
+}
@@ -9,19 +9,160 @@ import (
 )
 
 type Conversation struct {
-	ChatID  string
-	Title   string
-	Content []byte
+	ChatID   string
+	Title    string
+	Provider string
+	Model    string
+	// Render 按 width 列渲染对话中的消息, 窗口宽度变化时会重新调用
+	Render func(writer io.Writer, width int)
+}
+
+// Theme 界面的配色方案
+type Theme struct {
+	Name    string
+	Palette Palette
+}
+
+// Palette 界面使用的颜色, 颜色是 W3C 颜色名或者 #rrggbb
+type Palette struct {
+	Background             string `json:"background,omitempty"`
+	ContrastBackground     string `json:"contrast_background,omitempty"`
+	MoreContrastBackground string `json:"more_contrast_background,omitempty"`
+	Border                 string `json:"border,omitempty"`
+	Title                  string `json:"title,omitempty"`
+	Graphics               string `json:"graphics,omitempty"`
+	PrimaryText            string `json:"primary_text,omitempty"`
+	SecondaryText          string `json:"secondary_text,omitempty"`
+	TertiaryText           string `json:"tertiary_text,omitempty"`
+	InverseText            string `json:"inverse_text,omitempty"`
+	ContrastSecondaryText  string `json:"contrast_secondary_text,omitempty"`
+	// Muted 是快捷键提示和状态栏的文字颜色
+	Muted string `json:"muted,omitempty"`
+}
+
+// Block 是聊天窗口中可以复制的一块内容: 一条消息或者消息中的一个代码块
+type Block struct {
+	// Code 表示这是一个代码块, 否则是一条消息
+	Code bool
+	// Label 描述这块内容, 例如消息的角色或者代码的语言
+	Label string
+	// Source 是这块内容的原文, 而不是渲染后的文本
+	Source string
+}
+
+// BlockWriter 是可以记录 Block 位置的 writer, 渲染时在写入内容之前调用 MarkBlock,
+// offset 是 block 相对于接下来写入的内容的行数
+type BlockWriter interface {
+	io.Writer
+	MarkBlock(offset int, block Block)
+}
+
+// WidthWriter 是知道自己宽度的 writer, 写入它的消息按它的宽度排版
+type WidthWriter interface {
+	io.Writer
+	Width() int
+}
+
+// Model 可供选择的模型
+type Model struct {
+	Provider string
+	Name     string
+}
+
+// Settings 对话的生成参数, 为 nil 的字段使用模型的默认值
+type Settings struct {
+	Temperature     *float32
+	TopP            *float32
+	TopK            *int32
+	MaxOutputTokens *int32
+	StopSequences   []string
+	// CandidateCount 每次生成的回答数量, 多出的回答作为备选
+	CandidateCount *int32
+
+	// Safety 各类别的安全阈值, 没有设置的类别使用模型的默认值
+	Safety map[string]string
+	// SafetyCategories 和 SafetyThresholds 是可供选择的类别和阈值
+	SafetyCategories []string
+	SafetyThresholds []string
+}
+
+// Prompt 对话中用户发送的一条消息, Index 是它在对话中的位置
+type Prompt struct {
+	Index   int
+	Content string
+}
+
+// Branch 对话在 Index 处的一个分支, 是该位置 Count 个分支中的第 Branch 个
+type Branch struct {
+	Index    int
+	Branch   int
+	Count    int
+	Prompt   string
+	Selected bool
+}
+
+// Usage 对话占用的上下文窗口, 单位为 token
+type Usage struct {
+	Used  int
+	Limit int
 }
 
 type Backend interface {
 	GetConversation(ctx context.Context, chatID string) (*Conversation, error)
-	CreateConversation(ctx context.Context) (*Conversation, error)
+	// CreateConversation 新建一个对话, persona 为空时不使用 persona
+	CreateConversation(ctx context.Context, persona string) (*Conversation, error)
+	// DeleteConversation 删除对话, 对话正在回答时也会删除, 该回答之后不会再保存对话
 	DeleteConversation(ctx context.Context, chatID string) error
 	UpdateConversation(ctx context.Context, chatID, title string) error
+	// ForkConversation 复制对话的前 upTo 条消息到一个新对话, upTo 不大于 0 时复制所有消息
+	ForkConversation(ctx context.Context, chatID string, upTo int) (*Conversation, error)
+	// OnTitleChanged 注册对话标题被自动修改时的回调, fn 可能在任意 goroutine 中被调用
+	OnTitleChanged(fn func(chatID, title string))
 	ListConversation(ctx context.Context) ([]*Conversation, error)
 
-	Talk(ctx context.Context, chatID string, writer io.Writer, prompt string) error
+	// GetSettings 获取对话的生成参数
+	GetSettings(ctx context.Context, chatID string) (*Settings, error)
+	// UpdateSettings 修改对话的生成参数
+	UpdateSettings(ctx context.Context, chatID string, settings *Settings) error
+
+	// ListPersonas 列出所有 persona 的名字
+	ListPersonas(ctx context.Context) ([]string, error)
+
+	// ListThemes 列出所有可用的主题
+	ListThemes(ctx context.Context) ([]string, error)
+	// GetTheme 返回当前使用的主题
+	GetTheme(ctx context.Context) (*Theme, error)
+	// SetTheme 切换主题, 之后渲染的消息使用新主题的颜色
+	SetTheme(ctx context.Context, name string) (*Theme, error)
+
+	// ListModels 列出所有可用的模型
+	ListModels(ctx context.Context) ([]*Model, error)
+	// SetModel 设置新对话使用的模型, chatID 不为空时同时修改该对话的模型
+	SetModel(ctx context.Context, chatID, provider, model string) error
+
+	// Talk 发送 prompt 并将回答写入 writer, attachments 是随 prompt 一起发送的文件路径.
+	// prompt 在调用前保存, 调用失败时错误作为失败的回答保存, 可以通过 Regenerate 重试
+	Talk(ctx context.Context, chatID string, writer io.Writer, prompt string, attachments ...string) error
+
+	// Regenerate 重新生成最后一个回答并将其写入 writer, 之前的回答作为备选保留.
+	// 最后一个回答失败或者还没有回答时, 新的回答会替换它
+	Regenerate(ctx context.Context, chatID string, writer io.Writer) error
+	// SelectAlternative 切换最后一个回答的备选, delta 为 1 时切换到下一个, -1 时切换到上一个
+	SelectAlternative(ctx context.Context, chatID string, delta int) error
+
+	// ListPrompts 列出当前分支中用户发送的消息
+	ListPrompts(ctx context.Context, chatID string) ([]*Prompt, error)
+	// EditPrompt 修改 index 处的消息并重新发送, 修改后的消息作为新的分支, 消息和回答会写入 writer
+	EditPrompt(ctx context.Context, chatID string, index int, writer io.Writer, prompt string) error
+	// ListBranches 列出当前分支上每个分叉点的所有分支
+	ListBranches(ctx context.Context, chatID string) ([]*Branch, error)
+	// SwitchBranch 切换到 index 处的第 branch 个分支
+	SwitchBranch(ctx context.Context, chatID string, index, branch int) error
+
+	// ContextUsage 获取对话占用的上下文窗口
+	ContextUsage(ctx context.Context, chatID string) (*Usage, error)
+	// PinLastExchange 固定或取消固定对话的最后一轮问答, 返回是否已固定
+	PinLastExchange(ctx context.Context, chatID string) (bool, error)
 }
 
 type Primitive interface {
@@ -36,29 +177,55 @@ type HistoryWidget interface {
 	NewHistory(conv *Conversation)
 	// GetCurrentChatID 获取当前聊天窗口的 chat id
 	GetCurrentChatID() string
+	// SetTitle 修改历史记录的标题
+	SetTitle(chatID, title string)
+	// SetCurrentChatID 选中 chatID 对应的历史记录
+	SetCurrentChatID(chatID string)
 }
 
 // InputWidget 用户输入组件
 type InputWidget interface {
 	Primitive
+
+	// SetAttachments 显示将随下一条消息发送的附件
+	SetAttachments(names []string)
+	// Text 返回输入框中的内容
+	Text() string
+	// SetText 替换输入框中的内容
+	SetText(text string)
+	// SetEditing 显示正在修改的消息, label 为空时不显示
+	SetEditing(label string)
 }
 
 // ChatWidget 聊天窗口组件
 type ChatWidget interface {
 	Primitive
-	// Writer 返回当前的 chat view 的 writer, 用于写入聊天内容
-	// Writer(chatID string) io.Writer
-	Writer() io.Writer
+	// Writer 返回 chatID 对应的 chat view 的 writer, 用于写入聊天内容.
+	// 回答写入它所属的对话, 即使用户已经切换到了其他对话
+	Writer(chatID string) io.Writer
 
 	// NewChatView 新建一个聊天窗口, 并切换到该窗口
 	NewChatView(conversation *Conversation)
+	// ReloadView 用 conversation 的内容替换对应聊天窗口的内容
+	ReloadView(conversation *Conversation)
 
 	// SwitchView 切换 chat view
 	SwitchView(chatID string) bool
 
 	DeleteView(chatID string)
+	// HasView 判断 chatID 对应的 chat view 是否存在, 被删除的对话没有 chat view
+	HasView(chatID string) bool
+
+	// SetTitle 修改 chat view 的标题
+	SetTitle(chatID, title string)
+
+	// Model 返回当前 chat view 使用的模型, 未知时返回 nil
+	Model() *Model
+	// SetModel 修改 chat view 使用的模型
+	SetModel(chatID string, model *Model)
 
-	SetTitle(title string)
+	// SetStreaming 标记 chat view 正在写入回答, 写入期间宽度变化时不会重新渲染
+	SetStreaming(chatID string, streaming bool)
 }
 
 type WarningWidget interface {